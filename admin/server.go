@@ -0,0 +1,209 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/grpcsuit"
+)
+
+// Server serves health, readiness, metrics, pprof and the discovery view of the process over http.
+type Server struct {
+	httpServer *http.Server
+	startedAt  time.Time
+	ready      atomic.Bool
+	mu         sync.RWMutex
+	srvNodes   map[string]*discovery.Node
+	fallback   http.Handler
+}
+
+type Option func(*Server)
+
+// WithFallback serves paths not handled by the admin server by handler instead of http.DefaultServeMux.
+func WithFallback(handler http.Handler) Option {
+	return func(s *Server) {
+		s.fallback = handler
+	}
+}
+
+func NewServer(addr string, opts ...Option) *Server {
+	s := &Server{
+		startedAt: time.Now(),
+		srvNodes:  map[string]*discovery.Node{},
+		fallback:  http.DefaultServeMux,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/discovery", s.handleDiscovery)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// handlers registered to the default mux by the process, e.g. expvar, are served as well
+	mux.Handle("/", s.fallback)
+
+	s.httpServer = &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	return s
+}
+
+func (s *Server) Handler() http.Handler {
+	return s.httpServer.Handler
+}
+
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	err := s.httpServer.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.SetReady(false)
+	return s.httpServer.Shutdown(ctx)
+}
+
+// SetReady decides what /readyz answers, it's not ready until set.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+func (s *Server) IsReady() bool {
+	return s.ready.Load()
+}
+
+// AddRegistered adds node registered to srvName by the process to the discovery view.
+func (s *Server) AddRegistered(srvName string, node *discovery.Node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.srvNodes[srvName] = node
+}
+
+// RemoveRegistered removes the node registered to srvName from the discovery view.
+func (s *Server) RemoveRegistered(srvName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.srvNodes, srvName)
+}
+
+func (s *Server) getRegistered() map[string]*discovery.Node {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	srvNodes := make(map[string]*discovery.Node, len(s.srvNodes))
+	for srvName, node := range s.srvNodes {
+		srvNodes[srvName] = node
+	}
+	return srvNodes
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("ok"))
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	if !s.IsReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("not ready"))
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+type discoveryView struct {
+	Ready      bool                       `json:"ready"`
+	Registered map[string]*discovery.Node `json:"registered"`
+	Resolvers  []*grpcsuit.ResolverState  `json:"resolvers"`
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, _ *http.Request) {
+	view := &discoveryView{
+		Ready:      s.IsReady(),
+		Registered: s.getRegistered(),
+		Resolvers:  grpcsuit.GetResolverStates(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(view)
+}
+
+// handleMetrics writes metrics in the prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	var ready int
+	if s.IsReady() {
+		ready = 1
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "microgosuit_ready", "gauge", "Whether the process is registered and ready.", float64(ready))
+	writeMetric(w, "microgosuit_uptime_seconds", "gauge", "Seconds since the process started serving.", time.Since(s.startedAt).Seconds())
+	writeMetric(w, "microgosuit_registered_services", "gauge", "Number of services the process registered to.", float64(len(s.getRegistered())))
+
+	states := grpcsuit.GetResolverStates()
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Scheme != states[j].Scheme {
+			return states[i].Scheme < states[j].Scheme
+		}
+		return states[i].SrvName < states[j].SrvName
+	})
+	writeMetricHeader(w, "microgosuit_resolved_nodes", "gauge", "Number of available nodes resolved of a service.")
+	for _, state := range states {
+		var nodesNum int
+		if state.Srv != nil {
+			for _, node := range state.Srv.Nodes {
+				if node.Available() {
+					nodesNum++
+				}
+			}
+		}
+		_, _ = fmt.Fprintf(w, "microgosuit_resolved_nodes{scheme=%q,srv_name=%q} %d\n", state.Scheme, state.SrvName, nodesNum)
+	}
+
+	writeMetric(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	writeMetric(w, "go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", float64(memStats.Alloc))
+	writeMetric(w, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.", float64(memStats.Sys))
+	writeMetric(w, "go_gc_cycles_total", "counter", "Number of completed GC cycles.", float64(memStats.NumGC))
+}
+
+func writeMetricHeader(w http.ResponseWriter, name, typ, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeMetric(w http.ResponseWriter, name, typ, help string, val float64) {
+	writeMetricHeader(w, name, typ, help)
+	_, _ = fmt.Fprintf(w, "%s %v\n", name, val)
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/995933447/microgosuit/admin"
+	"github.com/995933447/microgosuit/discovery"
+)
+
+func TestServer(t *testing.T) {
+	// paths not handled by the admin server fall back to the mux given
+	fallback := http.NewServeMux()
+	fallback.HandleFunc("/admin_test/fallback", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("fallback"))
+	})
+	server := admin.NewServer("127.0.0.1:0", admin.WithFallback(fallback))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(httpServer.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := get("/healthz"); code != http.StatusOK || body != "ok" {
+		t.Fatalf("unexpected healthz %d %s", code, body)
+	}
+
+	// not ready until set, and not ready again once unset on shutdown
+	for _, ready := range []bool{false, true, false} {
+		server.SetReady(ready)
+
+		expectCode, expectGauge := http.StatusServiceUnavailable, "microgosuit_ready 0\n"
+		if ready {
+			expectCode, expectGauge = http.StatusOK, "microgosuit_ready 1\n"
+		}
+		if code, body := get("/readyz"); code != expectCode {
+			t.Fatalf("expect readyz %d if ready %v, got %d %s", expectCode, ready, code, body)
+		}
+		if _, body := get("/metrics"); !strings.Contains(body, expectGauge) {
+			t.Fatalf("expect %q in metrics if ready %v, got %s", expectGauge, ready, body)
+		}
+	}
+
+	server.AddRegistered("logv3", discovery.NewNode("127.2.1.1", 12014))
+	code, body := get("/metrics")
+	if code != http.StatusOK || !strings.Contains(body, "microgosuit_registered_services 1\n") || !strings.Contains(body, "# TYPE go_goroutines gauge\n") {
+		t.Fatalf("unexpected metrics %d %s", code, body)
+	}
+
+	if _, body = get("/discovery"); !strings.Contains(body, `"logv3"`) {
+		t.Fatalf("expect logv3 in discovery view, got %s", body)
+	}
+
+	if code, body = get("/admin_test/fallback"); code != http.StatusOK || body != "fallback" {
+		t.Fatalf("unexpected fallback %d %s", code, body)
+	}
+	if code, _ = get("/admin_test/missing"); code != http.StatusNotFound {
+		t.Fatalf("expect not found, got %d", code)
+	}
+}
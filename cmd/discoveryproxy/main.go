@@ -0,0 +1,72 @@
+// Command discoveryproxy syncs services in discovery to the cache directory set in meta, for filecachedproxy
+// discoveries on the same host.
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/995933447/microgosuit/discoveryproxy"
+	"github.com/995933447/microgosuit/env"
+	"github.com/995933447/microgosuit/log"
+)
+
+func main() {
+	metaFilePath := flag.String("meta", "", "path of meta file, the default one of the platform if empty")
+	keyPrefix := flag.String("prefix", "", "key prefix of services in discovery")
+	stopTimeout := flag.Duration("stop-timeout", 10*time.Second, "how long to wait for the proxy to stop")
+	flag.Parse()
+
+	if err := run(*metaFilePath, *keyPrefix, *stopTimeout); err != nil {
+		log.Logger.Error(nil, err)
+		os.Exit(1)
+	}
+}
+
+func run(metaFilePath, keyPrefix string, stopTimeout time.Duration) error {
+	if err := env.InitMeta(metaFilePath); err != nil {
+		return err
+	}
+
+	proxy, err := discoveryproxy.NewProxy(keyPrefix)
+	if err != nil {
+		return err
+	}
+
+	signCh := make(chan os.Signal, 1)
+	signal.Notify(signCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signCh)
+
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- proxy.Run()
+	}()
+
+	log.Logger.Infof(nil, "discovery proxy started, pid:%d, dir:%s", os.Getpid(), env.MustMeta().DiscoveryProxy.Dir)
+
+	var runErr error
+	select {
+	case sign := <-signCh:
+		log.Logger.Infof(nil, "discovery proxy stopping by signal %s", sign)
+	case runErr = <-runErrCh:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	if err = proxy.Stop(ctx); err != nil {
+		log.Logger.Error(nil, err)
+	}
+
+	if runErr != nil {
+		return runErr
+	}
+
+	log.Logger.Infof(nil, "discovery proxy stopped")
+
+	return nil
+}
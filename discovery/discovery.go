@@ -3,17 +3,24 @@ package discovery
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
 	ErrSrvNotFound  = errors.New("service not found")
 	ErrNodeNotFound = errors.New("node not found")
+	ErrClosed       = errors.New("discovery closed")
 )
 
+// DefaultLeaseTTL is used by RegisterWithLease when the given ttl is not positive.
+const DefaultLeaseTTL = 10 * time.Second
+
 const (
-	NodeStateNil   = 0
-	NodeStateAlive = 1
-	NodeStateDead  = 2
+	NodeStateNil      = 0
+	NodeStateAlive    = 1
+	NodeStateDead     = 2
+	NodeStateDraining = 4 // takes no new calls but keeps serving the ones in flight until unregistered
 )
 
 func NewNode(host string, port int) *Node {
@@ -24,22 +31,143 @@ func NewNode(host string, port int) *Node {
 }
 
 type Node struct {
-	Host      string `json:"ip"`
-	Port      int    `json:"port"`
-	Status    int    `json:"status"`
-	Priority  int    `json:"priority"` // as high as bigger
-	Name      string `json:"name"`
-	SlaveFlag int    `json:"slave_flag"`
-	Extra     string `json:"extra"`
+	Host      string            `json:"ip"`
+	Port      int               `json:"port"`
+	Status    int               `json:"status"`
+	Priority  int               `json:"priority"` // as high as bigger
+	Name      string            `json:"name"`
+	SlaveFlag int               `json:"slave_flag"`
+	Extra     string            `json:"extra"` // Deprecated: please use field Labels
+	Labels    map[string]string `json:"labels,omitempty"`
+	Zone      string            `json:"zone,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	StartedAt int64             `json:"started_at,omitempty"` // unix timestamp in seconds
 }
 
+// Available reports whether node takes new calls.
 func (n *Node) Available() bool {
-	return (n.Status & NodeStateDead) == 0
+	return (n.Status & (NodeStateDead | NodeStateDraining)) == 0
+}
+
+func (n *Node) IsDraining() bool {
+	return (n.Status & NodeStateDraining) != 0
+}
+
+// LabelLane is the label of lane the node is deployed in, nodes in a lane only serve calls tagged with it.
+const LabelLane = "lane"
+
+func (n *Node) Label(key string) string {
+	return n.Labels[key]
+}
+
+// MatchLabels reports whether node has all labels of selector.
+func (n *Node) MatchLabels(selector map[string]string) bool {
+	for key, val := range selector {
+		if nodeVal, ok := n.Labels[key]; !ok || nodeVal != val {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *Node) IsSlave() bool {
+	return n.SlaveFlag != 0
+}
+
+// DefaultNodeWeight is the weight of nodes without a positive Priority.
+const DefaultNodeWeight = 100
+
+// Weight is the share of traffic the node takes relative to others, it's the Priority if positive. Note that a
+// node without Priority weighs DefaultNodeWeight, more than nodes of Priority 1-99, and no Priority gives a node
+// weight 0, drain the node to take it out of traffic instead.
+func (n *Node) Weight() int {
+	if n.Priority <= 0 {
+		return DefaultNodeWeight
+	}
+	return n.Priority
 }
 
 type Service struct {
-	SrvName string  `json:"srv_name"`
-	Nodes   []*Node `json:"nodes"`
+	SrvName       string          `json:"srv_name"`
+	Nodes         []*Node         `json:"nodes"`
+	TrafficSplits []*TrafficSplit `json:"traffic_splits,omitempty"`
+}
+
+// TrafficSplit sends Percent of calls to nodes of Version, calls not split go to nodes of versions not split.
+type TrafficSplit struct {
+	Version string  `json:"version"`
+	Percent float64 `json:"percent"`
+}
+
+func ValidateTrafficSplits(splits []*TrafficSplit) error {
+	var (
+		total    float64
+		versions = map[string]struct{}{}
+	)
+	for _, split := range splits {
+		if split.Version == "" {
+			return errors.New("invalid traffic split, empty version")
+		}
+		if _, ok := versions[split.Version]; ok {
+			return fmt.Errorf("invalid traffic split, version %s duplicated", split.Version)
+		}
+		versions[split.Version] = struct{}{}
+		if split.Percent < 0 || split.Percent > 100 {
+			return fmt.Errorf("invalid traffic split, percent %v of version %s out of [0, 100]", split.Percent, split.Version)
+		}
+		total += split.Percent
+	}
+
+	if total > 100 {
+		return fmt.Errorf("invalid traffic splits, total percent %v exceeds 100", total)
+	}
+
+	return nil
+}
+
+// NodeFilter reports whether node should be kept.
+type NodeFilter func(node *Node) bool
+
+func LabelsMatch(selector map[string]string) NodeFilter {
+	return func(node *Node) bool {
+		return node.MatchLabels(selector)
+	}
+}
+
+func InZone(zone string) NodeFilter {
+	return func(node *Node) bool {
+		return node.Zone == zone
+	}
+}
+
+func OfVersion(version string) NodeFilter {
+	return func(node *Node) bool {
+		return node.Version == version
+	}
+}
+
+// FilterNodes returns a copy of srv only having nodes kept by all filters, srv itself if no filters given.
+func FilterNodes(srv *Service, filters ...NodeFilter) *Service {
+	if len(filters) == 0 {
+		return srv
+	}
+
+	filtered := *srv
+	filtered.Nodes = nil
+	for _, node := range srv.Nodes {
+		keep := true
+		for _, filter := range filters {
+			if !filter(node) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			filtered.Nodes = append(filtered.Nodes, node)
+		}
+	}
+
+	return &filtered
 }
 
 type Evt int
@@ -50,14 +178,129 @@ const (
 	EvtUpdated
 )
 
+// OnSrvUpdatedFunc is called with changes of services, the WatchEvt of the change is attached to ctx.
 type OnSrvUpdatedFunc func(ctx context.Context, evt Evt, srv *Service)
 
+type WatchEvt struct {
+	Evt Evt
+	Srv *Service
+	// Diff is the change of nodes since the version delivered before, all nodes are added for the first one.
+	Diff *SrvDiff
+	// Revision increases monotonically with changes of the service, the snapshots delivered first by Watch carry
+	// the revision they are loaded at.
+	Revision int64
+}
+
+// NewWatchEvt makes the event changing a service from before to after, either of them may be nil.
+func NewWatchEvt(evt Evt, before, after *Service, revision int64) *WatchEvt {
+	return &WatchEvt{
+		Evt:      evt,
+		Srv:      after,
+		Diff:     DiffSrv(before, after),
+		Revision: revision,
+	}
+}
+
+type watchEvtCtxKey struct{}
+
+// WithWatchEvt attaches evt to ctx.
+func WithWatchEvt(ctx context.Context, evt *WatchEvt) context.Context {
+	return context.WithValue(ctx, watchEvtCtxKey{}, evt)
+}
+
+// WatchEvtFromCtx returns the event attached by WithWatchEvt, OnSrvUpdatedFunc gets the diff and revision of the
+// change by it.
+func WatchEvtFromCtx(ctx context.Context) (*WatchEvt, bool) {
+	evt, ok := ctx.Value(watchEvtCtxKey{}).(*WatchEvt)
+	return evt, ok
+}
+
+// NodeChange is a node existing both before and after a change.
+type NodeChange struct {
+	Before *Node
+	After  *Node
+}
+
+// SrvDiff is the difference of nodes between two versions of a service, nodes are identified by host and port.
+type SrvDiff struct {
+	Added   []*Node
+	Removed []*Node
+	// StateChanged are nodes whose Status changed.
+	StateChanged []*NodeChange
+}
+
+func (d *SrvDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.StateChanged) == 0
+}
+
+// DiffSrv returns the difference from before to after, either of them may be nil.
+func DiffSrv(before, after *Service) *SrvDiff {
+	type nodeKey struct {
+		host string
+		port int
+	}
+
+	beforeNodes := map[nodeKey]*Node{}
+	if before != nil {
+		for _, node := range before.Nodes {
+			beforeNodes[nodeKey{node.Host, node.Port}] = node
+		}
+	}
+
+	diff := &SrvDiff{}
+	if after != nil {
+		for _, node := range after.Nodes {
+			key := nodeKey{node.Host, node.Port}
+			old, ok := beforeNodes[key]
+			if !ok {
+				diff.Added = append(diff.Added, node)
+				continue
+			}
+			delete(beforeNodes, key)
+			if old.Status != node.Status {
+				diff.StateChanged = append(diff.StateChanged, &NodeChange{
+					Before: old,
+					After:  node,
+				})
+			}
+		}
+	}
+
+	if before != nil {
+		// keep the order of before
+		for _, node := range before.Nodes {
+			if _, ok := beforeNodes[nodeKey{node.Host, node.Port}]; ok {
+				diff.Removed = append(diff.Removed, node)
+			}
+		}
+	}
+
+	return diff
+}
+
 type Discovery interface {
 	LoadAll(ctx context.Context) ([]*Service, error)
 	Register(ctx context.Context, srvName string, node *Node) error
+	// RegisterWithLease registers node bound to a lease which is kept alive by the current process until
+	// Unregister is called. The node expires by itself once the keepalive stops and is registered again
+	// transparently if the lease is lost while the keepalive is still running.
+	RegisterWithLease(ctx context.Context, srvName string, node *Node, ttl time.Duration) error
 	Unregister(ctx context.Context, srvName string, node *Node, remove bool) error
 	UnregisterAll(ctx context.Context, srvName string) error
-	Discover(ctx context.Context, srvName string) (*Service, error)
+	// Drain marks node draining, it stays registered but takes no new calls until registered again.
+	Drain(ctx context.Context, srvName string, node *Node) error
+	// SetTrafficSplits replaces traffic splits of srvName, splits are cleared if empty.
+	SetTrafficSplits(ctx context.Context, srvName string, splits []*TrafficSplit) error
+	// Discover returns srvName only having nodes kept by filters.
+	Discover(ctx context.Context, srvName string, filters ...NodeFilter) (*Service, error)
+	// OnSrvUpdated sets the only callback of changes, the one set before is replaced. Use Watch instead if
+	// it's not the only subscriber in process.
 	OnSrvUpdated(OnSrvUpdatedFunc)
+	// Watch subscribes changes of srvNames, or all services if no srvNames given. Current services are delivered
+	// first as EvtUpdated, the channel is closed after ctx done or Unwatch called.
+	Watch(ctx context.Context, srvNames ...string) (<-chan *WatchEvt, error)
 	Unwatch()
+	// Close stops all goroutines and releases clients and file watchers, it's safe to call repeatedly. Keepalives
+	// of leases stop as well, so nodes registered with lease expire by themselves unless unregistered before.
+	Close(ctx context.Context) error
 }
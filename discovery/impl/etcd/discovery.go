@@ -5,40 +5,1200 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/995933447/microgosuit/discovery"
-	"github.com/995933447/microgosuit/discovery/util"
-	clientv3 "go.etcd.io/etcd/client/v3"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/util"
+	"github.com/995933447/microgosuit/log"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const maxReRegisterInterval = 30 * time.Second
+
+// Service is assembled from the service key(prefix/srvName), which holds the whole service and its traffic
+// splits, and the node keys(prefix/srvName/host:port), each of which holds one node.
+type Service struct {
+	*discovery.Service
+	version   int64
+	srvName   string
+	srvNodes  []*discovery.Node
+	srvSplits []*discovery.TrafficSplit
+	nodes     map[string]*discovery.Node
+	revs      map[string]int64
+	loadedRev int64 // changes until it are loaded already
+}
+
+func newService(srvName string) *Service {
+	return &Service{
+		srvName: srvName,
+		nodes:   map[string]*discovery.Node{},
+		revs:    map[string]int64{},
+	}
+}
+
+func (s *Service) put(key, nodeAddr string, kv *mvccpb.KeyValue) error {
+	if nodeAddr == "" {
+		srv := &discovery.Service{}
+		if err := json.Unmarshal(kv.Value, srv); err != nil {
+			return fmt.Errorf("json unmarshal service(%s)'s value failed, err:%s", s.srvName, err)
+		}
+		s.srvNodes = srv.Nodes
+		s.srvSplits = srv.TrafficSplits
+	} else {
+		node := &discovery.Node{}
+		if err := json.Unmarshal(kv.Value, node); err != nil {
+			return fmt.Errorf("json unmarshal node(%s) of service(%s) failed, err:%s", nodeAddr, s.srvName, err)
+		}
+		s.nodes[nodeAddr] = node
+	}
+	s.revs[key] = kv.ModRevision
+	if kv.ModRevision > s.version {
+		s.version = kv.ModRevision
+	}
+	return nil
+}
+
+func (s *Service) del(key, nodeAddr string, rev int64) {
+	if nodeAddr == "" {
+		s.srvNodes = nil
+		s.srvSplits = nil
+	} else {
+		delete(s.nodes, nodeAddr)
+	}
+	delete(s.revs, key)
+	if rev > s.version {
+		s.version = rev
+	}
+}
+
+func (s *Service) empty() bool {
+	return len(s.revs) == 0
+}
+
+// revision is the revision the service is up to date with.
+func (s *Service) revision() int64 {
+	if s.version > s.loadedRev {
+		return s.version
+	}
+	return s.loadedRev
+}
+
+// rebuild merges nodes of the service key and the node keys, node keys win if a node exists in both.
+func (s *Service) rebuild() {
+	srv := &discovery.Service{
+		SrvName:       s.srvName,
+		TrafficSplits: s.srvSplits,
+	}
+	for _, node := range s.srvNodes {
+		if _, ok := s.nodes[nodeAddr(node)]; ok {
+			continue
+		}
+		srv.Nodes = append(srv.Nodes, node)
+	}
+	addrs := make([]string, 0, len(s.nodes))
+	for addr := range s.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		srv.Nodes = append(srv.Nodes, s.nodes[addr])
+	}
+	s.Service = srv
+}
+
+func nodeAddr(node *discovery.Node) string {
+	return fmt.Sprintf("%s:%d", node.Host, node.Port)
+}
+
+// Layout decides how Register persists nodes, nodes of both layouts are always read.
+type Layout int
+
+const (
+	// LayoutNodeKey persists every node in its own key prefix/srvName/host:port.
+	LayoutNodeKey Layout = iota
+	// LayoutSrvKey persists all nodes of a service as a whole in key prefix/srvName. It's kept for the
+	// transition while readers only knowing this layout are still running. RegisterWithLease is refused by it,
+	// since a lease of the key would expire the whole service.
+	LayoutSrvKey
 )
 
-type Service struct {
-	*discovery.Service
-	version int64
-}
+var ErrLeaseOnSrvKey = errors.New("register with lease is not supported by LayoutSrvKey")
+
+type Option func(*Discovery)
+
+func WithLayout(layout Layout) Option {
+	return func(d *Discovery) {
+		d.layout = layout
+	}
+}
+
+// WithWatchHealthHook calls fn whenever the watch gets broken, recovered or resynced.
+func WithWatchHealthHook(fn func(health WatchHealth)) Option {
+	return func(d *Discovery) {
+		d.onWatchHealth = fn
+	}
+}
+
+// WithClient makes Discovery work with cli instead of the client made from etcdCfg.
+func WithClient(cli *clientv3.Client) Option {
+	return func(d *Discovery) {
+		d.etcd = cli
+	}
+}
+
+type lease struct {
+	id     atomic.Int64
+	node   atomic.Pointer[discovery.Node] // put again once the lease lost
+	cancel context.CancelFunc
+	doneCh chan struct{}
+}
+
+type Discovery struct {
+	*util.SpecSrvMuFactory
+	timeout       time.Duration
+	etcd          *clientv3.Client
+	srvMap        map[string]*Service
+	leases        map[string]*lease
+	mu            sync.RWMutex
+	onSrvUpdate   discovery.OnSrvUpdatedFunc
+	watchers      *util.Watchers
+	stopWatchCh   chan struct{}
+	watchDoneCh   chan struct{}
+	KeyPrefix     string
+	isWatched     bool
+	isLoadedAll   bool
+	loadedAllRev  int64
+	goneRevs      map[string]int64 // revisions services were removed at, their rest keys removed then are ignored
+	layout        Layout
+	healthMu      sync.Mutex
+	health        WatchHealth
+	onWatchHealth func(health WatchHealth)
+	ownsClient    bool
+	isClosed      bool
+	closeOnce     sync.Once
+}
+
+// Unwatch stops the watch and forgets the cached services, they are loaded and watched again by the next
+// LoadAll or Discover.
+func (d *Discovery) Unwatch() {
+	d.mu.Lock()
+	stopCh, doneCh := d.stopWatchCh, d.watchDoneCh
+	d.stopWatchCh = nil
+	d.mu.Unlock()
+
+	if stopCh != nil {
+		close(stopCh)
+		<-doneCh
+	}
+
+	d.watchers.CloseAll()
+}
+
+// Close stops the watch and keepalives of leases, the etcd client is closed unless it's given by WithClient.
+func (d *Discovery) Close(ctx context.Context) error {
+	var err error
+	d.closeOnce.Do(func() {
+		d.mu.Lock()
+		d.isClosed = true
+		keys := make([]string, 0, len(d.leases))
+		for key := range d.leases {
+			keys = append(keys, key)
+		}
+		d.mu.Unlock()
+
+		doneCh := make(chan struct{})
+		go func() {
+			defer close(doneCh)
+			d.Unwatch()
+			for _, key := range keys {
+				d.stopKeepAlive(key)
+			}
+		}()
+
+		select {
+		case <-doneCh:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if d.ownsClient {
+			if closeErr := d.etcd.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (d *Discovery) Unregister(ctx context.Context, srvName string, node *discovery.Node, remove bool) error {
+	if srvName == "" {
+		return errors.New("invalid serviceName, empty")
+	}
+
+	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
+	if hasCancel {
+		defer cancel()
+	}
+
+	if err := d.unregisterNodeKey(ctx, srvName, node, remove); err != nil {
+		return err
+	}
+
+	return d.updateSrvKeyNode(ctx, srvName, node, func(n *discovery.Node) bool {
+		if remove {
+			return false
+		}
+		n.Status = discovery.NodeStateDead
+		n.Extra = node.Extra
+		return true
+	})
+}
+
+// unregisterNodeKey stops keeping alive the lease of node and removes it or marks it dead.
+// A node marked dead keeps its lease, so it expires by itself once the lease is no longer kept alive.
+func (d *Discovery) unregisterNodeKey(ctx context.Context, srvName string, node *discovery.Node, remove bool) error {
+	key := d.nodeToEtcdKey(srvName, node)
+
+	l := d.stopKeepAlive(key)
+
+	if remove {
+		if _, err := d.etcd.Delete(ctx, key); err != nil {
+			return err
+		}
+		if l != nil {
+			if _, err := d.etcd.Revoke(ctx, clientv3.LeaseID(l.id.Load())); err != nil {
+				log.Logger.Warnf(ctx, "revoke lease of node key %s failed, err:%s", key, err)
+			}
+		}
+		return nil
+	}
+
+	return d.updateNodeKey(ctx, key, func(n *discovery.Node) {
+		n.Status = discovery.NodeStateDead
+		n.Extra = node.Extra
+	})
+}
+
+// updateNodeKey changes node persisted in key by fn, the lease of key is kept.
+func (d *Discovery) updateNodeKey(ctx context.Context, key string, fn func(n *discovery.Node)) error {
+	resp, err := d.etcd.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil
+	}
+
+	n := &discovery.Node{}
+	if err = json.Unmarshal(resp.Kvs[0].Value, n); err != nil {
+		return err
+	}
+
+	fn(n)
+
+	nodeJson, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.etcd.Put(ctx, key, string(nodeJson), clientv3.WithLease(clientv3.LeaseID(resp.Kvs[0].Lease)))
+	if err != nil {
+		return err
+	}
+
+	d.mu.RLock()
+	if l, ok := d.leases[key]; ok {
+		l.node.Store(n)
+	}
+	d.mu.RUnlock()
+
+	return nil
+}
+
+func (d *Discovery) Drain(ctx context.Context, srvName string, node *discovery.Node) error {
+	if srvName == "" {
+		return errors.New("invalid serviceName, empty")
+	}
+
+	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
+	if hasCancel {
+		defer cancel()
+	}
+
+	err := d.updateNodeKey(ctx, d.nodeToEtcdKey(srvName, node), func(n *discovery.Node) {
+		n.Status = discovery.NodeStateDraining
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.updateSrvKeyNode(ctx, srvName, node, func(n *discovery.Node) bool {
+		n.Status = discovery.NodeStateDraining
+		return true
+	})
+}
+
+// srvKeyMayHoldNode reports whether the service key of srvName may hold node. A service in watch is kept up to
+// date, so it's only unknown for services not discovered yet.
+func (d *Discovery) srvKeyMayHoldNode(srvName string, node *discovery.Node) bool {
+	oneSrvMu := d.MakeOrGetOpOneSrvMu(srvName)
+
+	oneSrvMu.Lock()
+	defer oneSrvMu.Unlock()
+
+	d.mu.RLock()
+	srv, ok := d.srvMap[srvName]
+	d.mu.RUnlock()
+	if !ok {
+		return true
+	}
+
+	for _, n := range srv.srvNodes {
+		if n.Host == node.Host && n.Port == node.Port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateSrvKeyNode changes node persisted in the service key of srvName by fn, node is removed if fn returns
+// false. Nothing is written unless the service key holds node, which is rare once nodes are in node keys.
+func (d *Discovery) updateSrvKeyNode(ctx context.Context, srvName string, node *discovery.Node, fn func(n *discovery.Node) bool) error {
+	if !d.srvKeyMayHoldNode(srvName, node) {
+		return nil
+	}
+
+	key := d.srvNameToEtcdKey(srvName)
+	maxRetry := 3
+	for retry := 0; retry < maxRetry; retry++ {
+		resp, err := d.etcd.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if len(resp.Kvs) == 0 {
+			return nil
+		}
+
+		srv := &discovery.Service{}
+		err = json.Unmarshal(resp.Kvs[0].Value, srv)
+		if err != nil {
+			return err
+		}
+
+		existed := false
+		var remainedNodes []*discovery.Node
+		for _, n := range srv.Nodes {
+			if n.Host != node.Host || n.Port != node.Port {
+				remainedNodes = append(remainedNodes, n)
+				continue
+			}
+
+			existed = true
+			if fn(n) {
+				remainedNodes = append(remainedNodes, n)
+			}
+		}
+
+		if !existed {
+			return nil
+		}
+
+		srv.Nodes = remainedNodes
+
+		ok, err := d.atomicPersistSrv(ctx, srvName, resp.Kvs[0].Version, srv)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("set conflicted and retry fail, key %s", key))
+}
+
+func (d *Discovery) srvNameToEtcdKey(srvName string) string {
+	return d.KeyPrefix + srvName
+}
+
+func (d *Discovery) nodeToEtcdKey(srvName string, node *discovery.Node) string {
+	return d.srvNameToEtcdKey(srvName) + "/" + nodeAddr(node)
+}
+
+// parseEtcdKey resolves the service name and, for node keys, the node address(host:port) of key.
+func (d *Discovery) parseEtcdKey(key string) (srvName, nodeAddr string, ok bool) {
+	if !strings.HasPrefix(key, d.KeyPrefix) {
+		return "", "", false
+	}
+
+	srvName = key[len(d.KeyPrefix):]
+	if pos := strings.IndexByte(srvName, '/'); pos >= 0 {
+		srvName, nodeAddr = srvName[:pos], srvName[pos+1:]
+	}
+
+	if srvName == "" {
+		return "", "", false
+	}
+
+	return srvName, nodeAddr, true
+}
+
+func (d *Discovery) UnregisterAll(ctx context.Context, srvName string) error {
+	if srvName == "" {
+		return errors.New("invalid serviceName, empty")
+	}
+
+	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
+	if hasCancel {
+		defer cancel()
+	}
+
+	key := d.srvNameToEtcdKey(srvName)
+	_, err := d.etcd.Txn(ctx).Then(
+		clientv3.OpDelete(key),
+		clientv3.OpDelete(key+"/", clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WatchHealth reports the state of the watch keeping cached services up to date.
+type WatchHealth struct {
+	// Healthy is false while the watch is broken and being recovered.
+	Healthy bool
+	// Revision is the latest revision the cached services are up to date with.
+	Revision int64
+	// LastErr is the error broke the watch last time.
+	LastErr error
+	// Resyncs counts the full resyncs done because the revision to resume from was compacted.
+	Resyncs   int
+	UpdatedAt time.Time
+}
+
+var errWatchClosed = errors.New("watch channel closed")
+
+// WatchHealth returns the current health of the watch, it's unhealthy before the watch started.
+func (d *Discovery) WatchHealth() WatchHealth {
+	d.healthMu.Lock()
+	defer d.healthMu.Unlock()
+	return d.health
+}
+
+func (d *Discovery) reportWatchHealth(rev int64, err error, resynced bool) {
+	d.healthMu.Lock()
+	changed := d.health.Healthy != (err == nil) || err != nil || resynced
+	d.health.Healthy = err == nil
+	if rev > d.health.Revision {
+		d.health.Revision = rev
+	}
+	if err != nil {
+		d.health.LastErr = err
+	}
+	if resynced {
+		d.health.Resyncs++
+	}
+	d.health.UpdatedAt = time.Now()
+	health := d.health
+	d.healthMu.Unlock()
+
+	if changed && d.onWatchHealth != nil {
+		d.onWatchHealth(health)
+	}
+}
+
+// startWatch starts watching changes after rev unless the watch is running.
+func (d *Discovery) startWatch(rev int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.startWatchLocked(rev)
+}
+
+// startWatchLocked is startWatch with d.mu held, so the watch never applies changes before the caller caches
+// services loaded at rev.
+func (d *Discovery) startWatchLocked(rev int64) {
+	if d.isWatched || d.isClosed {
+		return
+	}
+	d.isWatched = true
+	d.stopWatchCh = make(chan struct{})
+	d.watchDoneCh = make(chan struct{})
+	go d.watch(rev, d.stopWatchCh, d.watchDoneCh)
+}
+
+// watch applies changes after rev to the cached services until stopCh closed. A broken watch is resumed from the
+// last revision applied, services are resynced as a whole if the revision was compacted meanwhile.
+func (d *Discovery) watch(rev int64, stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.isWatched = false
+		d.isLoadedAll = false
+		d.loadedAllRev = 0
+		d.srvMap = map[string]*Service{}
+		d.goneRevs = map[string]int64{}
+	}()
+
+	retryInterval := time.Second
+	for {
+		ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+		evtCh := d.etcd.Watch(ctx, d.KeyPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1), clientv3.WithProgressNotify(), clientv3.WithCreatedNotify())
+		lastRev, err := d.consumeWatch(evtCh, rev, stopCh)
+		cancel()
+		if lastRev > rev {
+			rev = lastRev
+			retryInterval = time.Second
+		}
+		if err == nil {
+			return
+		}
+
+		d.reportWatchHealth(rev, err, false)
+
+		for {
+			log.Logger.Warnf(nil, "watch of %s broken at revision %d, err:%s, watch again after %s", d.KeyPrefix, rev, err, retryInterval)
+
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(retryInterval):
+			}
+
+			retryInterval *= 2
+			if retryInterval > maxReRegisterInterval {
+				retryInterval = maxReRegisterInterval
+			}
+
+			if !errors.Is(err, rpctypes.ErrCompacted) {
+				break
+			}
+
+			if rev, err = d.resync(); err == nil {
+				log.Logger.Infof(nil, "services of %s resynced at revision %d", d.KeyPrefix, rev)
+				d.reportWatchHealth(rev, nil, true)
+				break
+			}
+			// keep resyncing until succeeded
+			err = fmt.Errorf("%w, resync failed, err:%s", rpctypes.ErrCompacted, err)
+		}
+	}
+}
+
+// consumeWatch applies responses of evtCh until it's broken, it returns the last revision applied and a nil
+// error if stopCh closed.
+func (d *Discovery) consumeWatch(evtCh clientv3.WatchChan, rev int64, stopCh chan struct{}) (int64, error) {
+	for {
+		select {
+		case <-stopCh:
+			return rev, nil
+		case resp, ok := <-evtCh:
+			if !ok {
+				return rev, errWatchClosed
+			}
+			if resp.CompactRevision != 0 {
+				return rev, rpctypes.ErrCompacted
+			}
+			if err := resp.Err(); err != nil {
+				return rev, err
+			}
+			if resp.Canceled {
+				return rev, errWatchClosed
+			}
+			if resp.Created {
+				d.reportWatchHealth(rev, nil, false)
+				continue
+			}
+
+			for _, evt := range resp.Events {
+				if err := d.applyEvt(evt); err != nil {
+					// resumed from evt, changes of the same revision applied already are applied again harmlessly
+					if rev >= evt.Kv.ModRevision {
+						rev = evt.Kv.ModRevision - 1
+					}
+					return rev, err
+				}
+				if evt.Kv.ModRevision > rev {
+					rev = evt.Kv.ModRevision
+				}
+			}
+
+			// only a progress notification guarantees every change until its revision was delivered
+			if resp.IsProgressNotify() && resp.Header.Revision > rev {
+				rev = resp.Header.Revision
+				d.reportWatchHealth(rev, nil, false)
+			}
+		}
+	}
+}
+
+// applyEvt applies evt to the cached services. A service not cached is loaded as a whole, since it can't be
+// assembled from a single key, unless all services were loaded before evt, in which case evt must be its first key.
+func (d *Discovery) applyEvt(evt *clientv3.Event) error {
+	key := string(evt.Kv.Key)
+	srvName, addr, ok := d.parseEtcdKey(key)
+	if !ok {
+		return nil
+	}
+
+	oneSrvMu := d.MakeOrGetOpOneSrvMu(srvName)
+
+	oneSrvMu.Lock()
+
+	d.mu.RLock()
+	srv, ok := d.srvMap[srvName]
+	isLoadedAll := d.isLoadedAll
+	loadedAllRev := d.loadedAllRev
+	goneRev := d.goneRevs[srvName]
+	d.mu.RUnlock()
+
+	var before *discovery.Service
+	switch {
+	case ok:
+		// the change was loaded already
+		if evt.Kv.ModRevision <= srv.loadedRev || srv.revs[key] > evt.Kv.ModRevision {
+			oneSrvMu.Unlock()
+			return nil
+		}
+		before = srv.Service
+	case evt.Kv.ModRevision <= goneRev:
+		// the rest keys of a service removed as a whole
+		oneSrvMu.Unlock()
+		return nil
+	case isLoadedAll && evt.Kv.ModRevision > loadedAllRev:
+		srv = newService(srvName)
+	default:
+		ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(context.Background())
+		var err error
+		srv, err = d.loadSrv(ctx, srvName)
+		if hasCancel {
+			cancel()
+		}
+		if err != nil {
+			oneSrvMu.Unlock()
+			return err
+		}
+		// evt is loaded already
+		evt = nil
+	}
+
+	rev := srv.loadedRev
+
+	// srv is shared with readers of srvMap once cached
+	d.mu.Lock()
+	if evt != nil {
+		rev = evt.Kv.ModRevision
+		switch evt.Type {
+		case clientv3.EventTypePut:
+			if err := srv.put(key, addr, evt.Kv); err != nil {
+				log.Logger.Error(nil, err)
+				srv.del(key, addr, evt.Kv.ModRevision)
+			}
+		case clientv3.EventTypeDelete:
+			srv.del(key, addr, evt.Kv.ModRevision)
+		}
+	}
+	isEmpty := srv.empty()
+	if isEmpty {
+		delete(d.srvMap, srvName)
+		d.goneRevs[srvName] = rev
+	} else {
+		srv.rebuild()
+		d.srvMap[srvName] = srv
+	}
+	cur := srv.Service
+	d.mu.Unlock()
+	oneSrvMu.Unlock()
+
+	if !isEmpty {
+		d.notify(context.Background(), discovery.NewWatchEvt(discovery.EvtUpdated, before, cur, rev))
+	} else if before != nil {
+		d.notify(context.Background(), discovery.NewWatchEvt(discovery.EvtDeleted, before, &discovery.Service{
+			SrvName: srvName,
+		}, rev))
+	}
+
+	return nil
+}
+
+func (d *Discovery) resync() (int64, error) {
+	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(context.Background())
+	if hasCancel {
+		defer cancel()
+	}
+
+	resp, err := d.etcd.Get(ctx, d.KeyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	rev := resp.Header.Revision
+	loaded := map[string]*Service{}
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		srvName, addr, ok := d.parseEtcdKey(key)
+		if !ok {
+			continue
+		}
+
+		srv, ok := loaded[srvName]
+		if !ok {
+			srv = newService(srvName)
+			srv.loadedRev = rev
+			loaded[srvName] = srv
+		}
+
+		if err = srv.put(key, addr, kv); err != nil {
+			log.Logger.Error(nil, err)
+			srv.del(key, addr, kv.ModRevision)
+		}
+	}
+
+	// every service is loaded, the changes missed of services not cached are delivered as well
+	d.mu.Lock()
+	d.isLoadedAll = true
+	d.loadedAllRev = rev
+	var srvNames []string
+	for srvName := range d.srvMap {
+		srvNames = append(srvNames, srvName)
+	}
+	for srvName := range loaded {
+		if _, ok := d.srvMap[srvName]; !ok {
+			srvNames = append(srvNames, srvName)
+		}
+	}
+	d.mu.Unlock()
+
+	sort.Strings(srvNames)
+	for _, srvName := range srvNames {
+		oneSrvMu := d.MakeOrGetOpOneSrvMu(srvName)
+
+		oneSrvMu.Lock()
+
+		d.mu.Lock()
+		old, existed := d.srvMap[srvName]
+		srv, ok := loaded[srvName]
+		if ok && !srv.empty() {
+			srv.rebuild()
+			d.srvMap[srvName] = srv
+		} else {
+			delete(d.srvMap, srvName)
+			d.goneRevs[srvName] = rev
+		}
+		d.mu.Unlock()
+
+		oneSrvMu.Unlock()
+
+		var before *discovery.Service
+		if existed {
+			before = old.Service
+		}
+
+		switch {
+		case ok && !srv.empty():
+			if !existed || !sameRevs(old.revs, srv.revs) {
+				d.notify(context.Background(), discovery.NewWatchEvt(discovery.EvtUpdated, before, srv.Service, rev))
+			}
+		case existed:
+			d.notify(context.Background(), discovery.NewWatchEvt(discovery.EvtDeleted, before, &discovery.Service{
+				SrvName: srvName,
+			}, rev))
+		}
+	}
+
+	return rev, nil
+}
+
+func sameRevs(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, rev := range a {
+		if b[key] != rev {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Discovery) Discover(ctx context.Context, srvName string, filters ...discovery.NodeFilter) (*discovery.Service, error) {
+	srv, err := d.discover(ctx, srvName)
+	if err != nil {
+		return nil, err
+	}
+	return discovery.FilterNodes(srv, filters...), nil
+}
+
+// cachedSrv returns the cached service, which is read under the lock since events rebuild it in place.
+func (d *Discovery) cachedSrv(srvName string) (*discovery.Service, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	srv, ok := d.srvMap[srvName]
+	if !ok {
+		return nil, false
+	}
+	return srv.Service, true
+}
+
+func (d *Discovery) discover(ctx context.Context, srvName string) (*discovery.Service, error) {
+	if srv, ok := d.cachedSrv(srvName); ok {
+		return srv, nil
+	}
+
+	oneSrvMu := d.MakeOrGetOpOneSrvMu(srvName)
+
+	oneSrvMu.Lock()
+	defer oneSrvMu.Unlock()
+
+	if srv, ok := d.cachedSrv(srvName); ok {
+		return srv, nil
+	}
+
+	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
+	if hasCancel {
+		defer cancel()
+	}
+
+	srv, err := d.loadSrv(ctx, srvName)
+	if err != nil {
+		return nil, err
+	}
+
+	// changes after the loaded revision are never missed
+	d.startWatch(srv.loadedRev)
+
+	if srv.empty() {
+		return nil, discovery.ErrSrvNotFound
+	}
+
+	srv.rebuild()
+
+	d.mu.Lock()
+	d.srvMap[srvName] = srv
+	d.mu.Unlock()
+
+	return srv.Service, nil
+}
+
+// loadSrv loads srvName from its service key and node keys, the service returned is empty if none of them exists.
+func (d *Discovery) loadSrv(ctx context.Context, srvName string) (*Service, error) {
+	key := d.srvNameToEtcdKey(srvName)
+	resp, err := d.etcd.Txn(ctx).Then(
+		clientv3.OpGet(key),
+		clientv3.OpGet(key+"/", clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	srv := newService(srvName)
+	srv.loadedRev = resp.Header.Revision
+	for _, opResp := range resp.Responses {
+		for _, kv := range opResp.GetResponseRange().Kvs {
+			_, addr, ok := d.parseEtcdKey(string(kv.Key))
+			if !ok {
+				continue
+			}
+			if err = srv.put(string(kv.Key), addr, kv); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return srv, nil
+}
+
+func (d *Discovery) OnSrvUpdated(fn discovery.OnSrvUpdatedFunc) {
+	d.onSrvUpdate = fn
+}
+
+func (d *Discovery) Watch(ctx context.Context, srvNames ...string) (<-chan *discovery.WatchEvt, error) {
+	return d.watchers.Watch(ctx, srvNames, func(ctx context.Context) ([]*discovery.WatchEvt, error) {
+		return util.LoadSnapshot(ctx, srvNames, d.snapshot, d.loadSnapshot)
+	})
+}
+
+// loadSnapshot returns the snapshot of srvName at the revision it's cached at, it's loaded first if not cached.
+func (d *Discovery) loadSnapshot(ctx context.Context, srvName string) (*discovery.WatchEvt, error) {
+	if evt, ok := d.cachedSnapshot(srvName); ok {
+		return evt, nil
+	}
+
+	if _, err := d.discover(ctx, srvName); err != nil {
+		return nil, err
+	}
+
+	// removed right after loaded
+	evt, ok := d.cachedSnapshot(srvName)
+	if !ok {
+		return nil, discovery.ErrSrvNotFound
+	}
+
+	return evt, nil
+}
+
+func (d *Discovery) cachedSnapshot(srvName string) (*discovery.WatchEvt, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	srv, ok := d.srvMap[srvName]
+	if !ok {
+		return nil, false
+	}
+	return util.NewSnapshot(srv.Service, srv.revision()), true
+}
+
+func (d *Discovery) notify(ctx context.Context, evt *discovery.WatchEvt) {
+	if d.onSrvUpdate != nil {
+		d.onSrvUpdate(discovery.WithWatchEvt(ctx, evt), evt.Evt, evt.Srv)
+	}
+	d.watchers.Publish(evt)
+}
+
+func (d *Discovery) tryAddTimeoutToCtx(ctx context.Context) (triedCtx context.Context, cancel context.CancelFunc, hasCancel bool) {
+	if d.timeout > 0 {
+		triedCtx, cancel = context.WithTimeout(ctx, d.timeout)
+		hasCancel = true
+		return
+	}
+	triedCtx = ctx
+	return
+}
+
+func (d *Discovery) LoadAll(ctx context.Context) ([]*discovery.Service, error) {
+	evts, err := d.loadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*discovery.Service
+	for _, evt := range evts {
+		d.notify(ctx, evt)
+		services = append(services, evt.Srv)
+	}
+
+	return services, nil
+}
+
+// snapshot returns snapshots of all services like LoadAll without notifying anyone.
+func (d *Discovery) snapshot(ctx context.Context) ([]*discovery.WatchEvt, error) {
+	evts, err := d.loadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*discovery.WatchEvt
+	for _, evt := range evts {
+		snapshots = append(snapshots, util.NewSnapshot(evt.Srv, evt.Revision))
+	}
+
+	return snapshots, nil
+}
+
+// loadAll loads and watches all services, it returns their changes to be notified. A service cached already is
+// kept unless the loaded one is newer, so it never goes back to a revision older than the watch applied.
+func (d *Discovery) loadAll(ctx context.Context) ([]*discovery.WatchEvt, error) {
+	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
+	if hasCancel {
+		defer cancel()
+	}
+
+	resp, err := d.etcd.Get(ctx, d.KeyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	rev := resp.Header.Revision
+	var srvNames []string
+	loaded := map[string]*Service{}
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		srvName, addr, ok := d.parseEtcdKey(key)
+		if !ok {
+			continue
+		}
+
+		srv, ok := loaded[srvName]
+		if !ok {
+			srv = newService(srvName)
+			srv.loadedRev = rev
+			loaded[srvName] = srv
+			srvNames = append(srvNames, srvName)
+		}
+
+		if err = srv.put(key, addr, kv); err != nil {
+			return nil, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var evts []*discovery.WatchEvt
+	for _, srvName := range srvNames {
+		if d.goneRevs[srvName] >= rev {
+			continue
+		}
+
+		old, ok := d.srvMap[srvName]
+		if ok && old.revision() >= rev {
+			evts = append(evts, discovery.NewWatchEvt(discovery.EvtUpdated, old.Service, old.Service, old.revision()))
+			continue
+		}
+
+		var before *discovery.Service
+		if ok {
+			before = old.Service
+		}
+
+		srv := loaded[srvName]
+		srv.rebuild()
+		d.srvMap[srvName] = srv
+
+		evts = append(evts, discovery.NewWatchEvt(discovery.EvtUpdated, before, srv.Service, rev))
+	}
+
+	d.isLoadedAll = true
+	if rev > d.loadedAllRev {
+		d.loadedAllRev = rev
+	}
+
+	// changes after the loaded revision are never missed
+	d.startWatchLocked(rev)
+
+	return evts, nil
+}
+
+func (d *Discovery) Register(ctx context.Context, srvName string, node *discovery.Node) error {
+	if srvName == "" {
+		return errors.New("invalid serviceName, empty")
+	}
+
+	if node.Host == "" || node.Port == 0 {
+		return errors.New(fmt.Sprintf("invalid node, node %+v", node))
+	}
+
+	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
+	if hasCancel {
+		defer cancel()
+	}
+
+	if d.layout == LayoutSrvKey {
+		return d.registerToSrvKey(ctx, srvName, node)
+	}
+
+	n := *node
+	if !n.Available() {
+		n.Status = discovery.NodeStateAlive
+	}
+
+	nodeJson, err := json.Marshal(&n)
+	if err != nil {
+		return err
+	}
+
+	// registering without a lease detaches node from the lease kept alive before
+	key := d.nodeToEtcdKey(srvName, node)
+	l := d.stopKeepAlive(key)
+
+	if _, err = d.etcd.Put(ctx, key, string(nodeJson)); err != nil {
+		return err
+	}
+
+	if l != nil {
+		if _, err = d.etcd.Revoke(ctx, clientv3.LeaseID(l.id.Load())); err != nil {
+			log.Logger.Warnf(ctx, "revoke lease of node key %s failed, err:%s", key, err)
+		}
+	}
+
+	return nil
+}
+
+func (d *Discovery) registerToSrvKey(ctx context.Context, srvName string, node *discovery.Node) error {
+	key := d.srvNameToEtcdKey(srvName)
+	retry := 0
+	maxRetry := 3
+	for ; retry < maxRetry; retry++ {
+		resp, err := d.etcd.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		srv := &discovery.Service{
+			SrvName: srvName,
+		}
+		var srvVersion int64
+		if len(resp.Kvs) > 0 {
+			val := resp.Kvs[0].Value
+			err = json.Unmarshal(val, srv)
+			if err != nil {
+				return err
+			}
+			srvVersion = resp.Kvs[0].Version
+		}
+
+		// check node existed
+		existed := false
+		for _, n := range srv.Nodes {
+			if n.Host != node.Host || n.Port != node.Port {
+				continue
+			}
+
+			if !n.Available() {
+				n.Status = discovery.NodeStateAlive
+			}
+			n.Extra = node.Extra
+			n.Labels = node.Labels
+			n.Zone = node.Zone
+			n.Version = node.Version
+			n.StartedAt = node.StartedAt
+
+			existed = true
+			break
+		}
+		if !existed {
+			srv.Nodes = append(srv.Nodes, node)
+		}
+
+		ok, err := d.atomicPersistSrv(ctx, srvName, srvVersion, srv)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
 
-type Discovery struct {
-	*util.SpecSrvMuFactory
-	timeout       time.Duration
-	etcd          *clientv3.Client
-	srvMap        map[string]*Service
-	mu            sync.RWMutex
-	onSrvUpdate   discovery.OnSrvUpdatedFunc
-	unwatchSignCh chan struct{}
-	KeyPrefix     string
-	isWatched     bool
-}
+		break
+	}
 
-func (d *Discovery) Unwatch() {
-	d.unwatchSignCh <- struct{}{}
+	if retry == maxRetry {
+		return errors.New(fmt.Sprintf("set conflicted and retry fail, key %s", key))
+	}
+
+	return nil
 }
 
-func (d *Discovery) Unregister(ctx context.Context, srvName string, node *discovery.Node, remove bool) error {
+func (d *Discovery) SetTrafficSplits(ctx context.Context, srvName string, splits []*discovery.TrafficSplit) error {
 	if srvName == "" {
 		return errors.New("invalid serviceName, empty")
 	}
 
+	if err := discovery.ValidateTrafficSplits(splits); err != nil {
+		return err
+	}
+
 	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
 	if hasCancel {
 		defer cancel()
@@ -53,40 +1213,21 @@ func (d *Discovery) Unregister(ctx context.Context, srvName string, node *discov
 			return err
 		}
 
-		srv := &discovery.Service{}
-		if len(resp.Kvs) == 0 {
-			break
-		}
-
-		err = json.Unmarshal(resp.Kvs[0].Value, srv)
-		if err != nil {
-			return err
+		srv := &discovery.Service{
+			SrvName: srvName,
 		}
-
-		existed := false
-		var remainedNodes []*discovery.Node
-		for _, n := range srv.Nodes {
-			if n.Host != node.Host || n.Port != node.Port {
-				remainedNodes = append(remainedNodes, n)
-				continue
-			}
-
-			existed = true
-			if remove {
-				continue
+		var srvVersion int64
+		if len(resp.Kvs) > 0 {
+			err = json.Unmarshal(resp.Kvs[0].Value, srv)
+			if err != nil {
+				return err
 			}
-			n.Status = discovery.NodeStateDead
-			n.Extra = node.Extra
-			remainedNodes = append(remainedNodes, n)
-		}
-
-		if !existed {
-			return nil
+			srvVersion = resp.Kvs[0].Version
 		}
 
-		srv.Nodes = remainedNodes
+		srv.TrafficSplits = splits
 
-		ok, err := d.atomicPersistSrv(ctx, srvName, resp.Kvs[0].Version, srv)
+		ok, err := d.atomicPersistSrv(ctx, srvName, srvVersion, srv)
 		if err != nil {
 			return err
 		}
@@ -105,289 +1246,240 @@ func (d *Discovery) Unregister(ctx context.Context, srvName string, node *discov
 	return nil
 }
 
-func (d *Discovery) srvNameToEtcdKey(srvName string) string {
-	return d.KeyPrefix + srvName
-}
-
-func (d *Discovery) UnregisterAll(ctx context.Context, srvName string) error {
+func (d *Discovery) RegisterWithLease(ctx context.Context, srvName string, node *discovery.Node, ttl time.Duration) error {
 	if srvName == "" {
 		return errors.New("invalid serviceName, empty")
 	}
 
-	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
-	if hasCancel {
-		defer cancel()
+	if node.Host == "" || node.Port == 0 {
+		return errors.New(fmt.Sprintf("invalid node, node %+v", node))
 	}
 
-	_, err := d.etcd.Delete(ctx, d.srvNameToEtcdKey(srvName))
-	if err != nil {
-		return err
+	if d.layout == LayoutSrvKey {
+		return ErrLeaseOnSrvKey
 	}
 
-	return nil
-}
-
-func (d *Discovery) watch() {
-	if d.isWatched {
-		return
+	if ttl <= 0 {
+		ttl = discovery.DefaultLeaseTTL
 	}
 
-	d.mu.Lock()
-	if d.isWatched {
-		d.mu.Unlock()
-		return
+	d.mu.RLock()
+	isClosed := d.isClosed
+	d.mu.RUnlock()
+	if isClosed {
+		return discovery.ErrClosed
 	}
-	d.isWatched = true
-	d.mu.Unlock()
-
-	evtCh := d.etcd.Watch(context.Background(), d.KeyPrefix, clientv3.WithPrefix())
-	for {
-		select {
-		case <-d.unwatchSignCh:
-			goto out
-		case resp := <-evtCh:
-			for _, evt := range resp.Events {
-				key := string(evt.Kv.Key)
-				if !strings.HasPrefix(key, d.KeyPrefix) {
-					continue
-				}
-
-				srvName := key[len(d.KeyPrefix):]
-
-				d.mu.Lock()
-				oneSrvMu := d.MakeOrGetOpOneSrvMu(srvName)
-				d.mu.Unlock()
 
-				oneSrvMu.Lock()
-
-				srv, ok := d.srvMap[srvName]
-				if ok {
-					if srv.version > evt.Kv.ModRevision {
-						oneSrvMu.Unlock()
-						continue
-					}
-				}
+	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
+	if hasCancel {
+		defer cancel()
+	}
 
-				switch evt.Type {
-				case clientv3.EventTypePut:
-					cfg := &discovery.Service{}
-					err := json.Unmarshal(evt.Kv.Value, cfg)
-					if err != nil {
-						delete(d.srvMap, srvName)
-					} else {
-						d.srvMap[srvName] = &Service{
-							Service: cfg,
-							version: evt.Kv.ModRevision,
-						}
-					}
-					oneSrvMu.Unlock()
-					if d.onSrvUpdate != nil {
-						d.onSrvUpdate(context.Background(), discovery.EvtUpdated, cfg)
-					}
-				case clientv3.EventTypeDelete:
-					delete(d.srvMap, srvName)
-					oneSrvMu.Unlock()
-					if d.onSrvUpdate != nil {
-						d.onSrvUpdate(context.Background(), discovery.EvtDeleted, &discovery.Service{
-							SrvName: srvName,
-						})
-					}
-				}
-			}
-		}
+	// the node is kept alive in background, take a copy so later changes by caller won't race with it
+	leasedNode := *node
+	if !leasedNode.Available() {
+		leasedNode.Status = discovery.NodeStateAlive
 	}
-out:
-	if !d.isWatched {
-		return
+
+	key := d.nodeToEtcdKey(srvName, &leasedNode)
+	leaseId, err := d.grantAndPutNode(ctx, key, &leasedNode, ttl)
+	if err != nil {
+		return err
 	}
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	d.isWatched = false
-	d.srvMap = map[string]*Service{}
-	return
-}
 
-func (d *Discovery) Discover(ctx context.Context, srvName string) (*discovery.Service, error) {
-	d.mu.RLock()
-	srv, ok := d.srvMap[srvName]
-	d.mu.RUnlock()
-	if ok {
-		return srv.Service, nil
+	keepAliveCtx, cancelKeepAlive := context.WithCancel(context.Background())
+	l := &lease{
+		cancel: cancelKeepAlive,
+		doneCh: make(chan struct{}),
 	}
+	l.id.Store(int64(leaseId))
+	l.node.Store(&leasedNode)
 
 	d.mu.Lock()
-	oneSrvMu := d.MakeOrGetOpOneSrvMu(srvName)
+	if d.isClosed {
+		d.mu.Unlock()
+		cancelKeepAlive()
+		return discovery.ErrClosed
+	}
+	oldLease := d.leases[key]
+	d.leases[key] = l
 	d.mu.Unlock()
 
-	oneSrvMu.Lock()
-	defer oneSrvMu.Unlock()
-
-	srv, ok = d.srvMap[srvName]
-	if ok {
-		return srv.Service, nil
+	if oldLease != nil {
+		oldLease.cancel()
+		<-oldLease.doneCh
+		if _, err = d.etcd.Revoke(ctx, clientv3.LeaseID(oldLease.id.Load())); err != nil {
+			log.Logger.Warnf(ctx, "revoke lease of node key %s failed, err:%s", key, err)
+		}
 	}
 
-	if !d.isWatched {
-		go d.watch()
-	}
+	go d.keepAlive(keepAliveCtx, l, key, ttl)
 
-	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
-	if hasCancel {
-		defer cancel()
-	}
+	return nil
+}
 
-	resp, err := d.etcd.Get(ctx, d.srvNameToEtcdKey(srvName))
+func (d *Discovery) grantAndPutNode(ctx context.Context, key string, node *discovery.Node, ttl time.Duration) (clientv3.LeaseID, error) {
+	nodeJson, err := json.Marshal(node)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	if len(resp.Kvs) == 0 {
-		return nil, discovery.ErrSrvNotFound
+	ttlSec := int64(ttl / time.Second)
+	if ttlSec <= 0 {
+		ttlSec = 1
 	}
 
-	srvCfg := &discovery.Service{}
-	err = json.Unmarshal(resp.Kvs[0].Value, srvCfg)
+	grantResp, err := d.etcd.Grant(ctx, ttlSec)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	d.srvMap[srvName] = &Service{
-		Service: srvCfg,
-		version: resp.Kvs[0].ModRevision,
+	if _, err = d.etcd.Put(ctx, key, string(nodeJson), clientv3.WithLease(grantResp.ID)); err != nil {
+		return 0, err
 	}
 
-	return srvCfg, nil
+	return grantResp.ID, nil
 }
 
-func (d *Discovery) OnSrvUpdated(fn discovery.OnSrvUpdatedFunc) {
-	d.onSrvUpdate = fn
-}
+// keepAlive keeps the lease of node alive until ctx is canceled, a new lease is granted and the latest node is
+// put again whenever the old one is lost.
+func (d *Discovery) keepAlive(ctx context.Context, l *lease, key string, ttl time.Duration) {
+	defer close(l.doneCh)
 
-func (d *Discovery) tryAddTimeoutToCtx(ctx context.Context) (triedCtx context.Context, cancel context.CancelFunc, hasCancel bool) {
-	if d.timeout > 0 {
-		triedCtx, cancel = context.WithTimeout(ctx, d.timeout)
-		hasCancel = true
-		return
+	retryInterval := time.Second
+	for {
+		respCh, err := d.etcd.KeepAlive(ctx, clientv3.LeaseID(l.id.Load()))
+		if err == nil {
+			for range respCh {
+				retryInterval = time.Second
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Logger.Warnf(nil, "lease of node key %s lost, register again after %s", key, retryInterval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+
+		retryInterval *= 2
+		if retryInterval > maxReRegisterInterval {
+			retryInterval = maxReRegisterInterval
+		}
+
+		putCtx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
+		leaseId, err := d.grantAndPutNode(putCtx, key, l.node.Load(), ttl)
+		if hasCancel {
+			cancel()
+		}
+		if err != nil {
+			log.Logger.Errorf(nil, "register node key %s again failed, err:%s", key, err)
+			continue
+		}
+
+		l.id.Store(int64(leaseId))
+
+		log.Logger.Infof(nil, "registered node key %s again", key)
 	}
-	triedCtx = ctx
-	return
 }
 
-func (d *Discovery) LoadAll(ctx context.Context) ([]*discovery.Service, error) {
+func (d *Discovery) stopKeepAlive(key string) *lease {
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	l, ok := d.leases[key]
+	delete(d.leases, key)
+	d.mu.Unlock()
 
-	if !d.isWatched {
-		go d.watch()
+	if !ok {
+		return nil
 	}
 
-	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
-	if hasCancel {
-		defer cancel()
-	}
+	l.cancel()
+	<-l.doneCh
+
+	return l
+}
 
+// MigrateSrvKeys moves nodes persisted in service keys into their own node keys and removes the service keys
+// afterward. Nodes already owning a node key are kept as they are. It's safe to run repeatedly.
+func (d *Discovery) MigrateSrvKeys(ctx context.Context) error {
 	resp, err := d.etcd.Get(ctx, d.KeyPrefix, clientv3.WithPrefix())
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var services []*discovery.Service
 	for _, kv := range resp.Kvs {
-		key := string(kv.Key)
-		if !strings.HasPrefix(key, d.KeyPrefix) {
+		srvName, addr, ok := d.parseEtcdKey(string(kv.Key))
+		if !ok || addr != "" {
 			continue
 		}
 
-		srvName := key[len(d.KeyPrefix):]
-
-		srv := &discovery.Service{}
-		err = json.Unmarshal(kv.Value, srv)
-		if err != nil {
-			return nil, fmt.Errorf("json unmarshal service(%s)'s value failed, err:%s", srvName, err)
-		}
-
-		d.srvMap[srvName] = &Service{
-			Service: srv,
-			version: kv.ModRevision,
+		if err = d.migrateSrvKey(ctx, srvName, kv); err != nil {
+			return err
 		}
-
-		d.onSrvUpdate(ctx, discovery.EvtUpdated, srv)
-
-		services = append(services, srv)
 	}
 
-	return services, nil
+	return nil
 }
 
-func (d *Discovery) Register(ctx context.Context, srvName string, node *discovery.Node) error {
-	if srvName == "" {
-		return errors.New("invalid serviceName, empty")
+func (d *Discovery) migrateSrvKey(ctx context.Context, srvName string, kv *mvccpb.KeyValue) error {
+	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
+	if hasCancel {
+		defer cancel()
 	}
 
-	if node.Host == "" || node.Port == 0 {
-		return errors.New(fmt.Sprintf("invalid node, node %+v", node))
+	srv := &discovery.Service{}
+	if err := json.Unmarshal(kv.Value, srv); err != nil {
+		return fmt.Errorf("json unmarshal service(%s)'s value failed, err:%s", srvName, err)
 	}
 
-	ctx, cancel, hasCancel := d.tryAddTimeoutToCtx(ctx)
-	if hasCancel {
-		defer cancel()
+	if len(srv.Nodes) == 0 {
+		return nil
 	}
 
-	key := d.srvNameToEtcdKey(srvName)
-	retry := 0
-	maxRetry := 3
-	for ; retry < maxRetry; retry++ {
-		resp, err := d.etcd.Get(ctx, key)
+	for _, node := range srv.Nodes {
+		nodeJson, err := json.Marshal(node)
 		if err != nil {
 			return err
 		}
 
-		srv := &discovery.Service{
-			SrvName: srvName,
-		}
-		var srvVersion int64
-		if len(resp.Kvs) > 0 {
-			val := resp.Kvs[0].Value
-			err = json.Unmarshal(val, srv)
-			if err != nil {
-				return err
-			}
-			srvVersion = resp.Kvs[0].Version
-		}
-
-		// check node existed
-		existed := false
-		for _, n := range srv.Nodes {
-			if n.Host != node.Host || n.Port != node.Port {
-				continue
-			}
-
-			if !n.Available() {
-				n.Status = discovery.NodeStateAlive
-			}
-			n.Extra = node.Extra
-
-			existed = true
-			break
-		}
-		if !existed {
-			srv.Nodes = append(srv.Nodes, node)
-		}
-
-		ok, err := d.atomicPersistSrv(ctx, srvName, srvVersion, srv)
+		nodeKey := d.nodeToEtcdKey(srvName, node)
+		_, err = d.etcd.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(nodeKey), "=", 0)).
+			Then(clientv3.OpPut(nodeKey, string(nodeJson))).
+			Commit()
 		if err != nil {
 			return err
 		}
+	}
 
-		if !ok {
-			continue
+	key := d.srvNameToEtcdKey(srvName)
+	op := clientv3.OpDelete(key)
+	// traffic splits are only kept in the service key
+	if len(srv.TrafficSplits) > 0 {
+		srvJson, err := json.Marshal(&discovery.Service{
+			SrvName:       srvName,
+			TrafficSplits: srv.TrafficSplits,
+		})
+		if err != nil {
+			return err
 		}
-
-		break
+		op = clientv3.OpPut(key, string(srvJson))
+	}
+	resp, err := d.etcd.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).
+		Then(op).
+		Commit()
+	if err != nil {
+		return err
 	}
 
-	if retry == maxRetry {
-		return errors.New(fmt.Sprintf("set conflicted and retry fail, key %s", key))
+	if !resp.Succeeded {
+		return fmt.Errorf("service key %s changed while migrating, retry later", key)
 	}
 
 	return nil
@@ -402,7 +1494,7 @@ func (d *Discovery) atomicPersistSrv(ctx context.Context, srvName string, versio
 	key := d.srvNameToEtcdKey(srvName)
 	tx := d.etcd.Txn(ctx).
 		If(clientv3.Compare(clientv3.Version(key), "=", version))
-	if len(srv.Nodes) == 0 {
+	if len(srv.Nodes) == 0 && len(srv.TrafficSplits) == 0 {
 		tx.Then(clientv3.OpDelete(key))
 	} else {
 		tx.Then(clientv3.OpPut(key, string(srvJson)))
@@ -417,20 +1509,29 @@ func (d *Discovery) atomicPersistSrv(ctx context.Context, srvName string, versio
 
 var _ discovery.Discovery = (*Discovery)(nil)
 
-func NewDiscovery(keyPrefix string, timeout time.Duration, etcdCfg clientv3.Config) (discovery.Discovery, error) {
+func NewDiscovery(keyPrefix string, timeout time.Duration, etcdCfg clientv3.Config, opts ...Option) (discovery.Discovery, error) {
 	discover := &Discovery{
-		KeyPrefix:     keyPrefix,
-		timeout:       timeout,
-		srvMap:        map[string]*Service{},
-		unwatchSignCh: make(chan struct{}),
+		KeyPrefix: keyPrefix,
+		timeout:   timeout,
+		srvMap:    map[string]*Service{},
+		goneRevs:  map[string]int64{},
+		leases:    map[string]*lease{},
+		watchers:  util.NewWatchers(),
+	}
+
+	for _, opt := range opts {
+		opt(discover)
 	}
 
 	discover.SpecSrvMuFactory = util.NewSpecSrvMuFactory()
 
-	var err error
-	discover.etcd, err = clientv3.New(etcdCfg)
-	if err != nil {
-		return nil, err
+	if discover.etcd == nil {
+		var err error
+		discover.etcd, err = clientv3.New(etcdCfg)
+		if err != nil {
+			return nil, err
+		}
+		discover.ownsClient = true
 	}
 
 	return discover, nil
@@ -2,11 +2,12 @@ package filecachedproxy
 
 import (
 	"context"
-	"encoding/json"
-	"io"
+	"errors"
 	"os"
-	"strings"
+	"path/filepath"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/995933447/microgosuit/discovery"
@@ -15,62 +16,61 @@ import (
 	"github.com/howeyc/fsnotify"
 )
 
+// connRev is the revision of services loaded from conn before their cache files are synced, any file wins.
+const connRev = -1
+
 type Discovery struct {
 	discovery.FileCachedProxyContract
 	*util.SpecSrvMuFactory
 
-	dir             string
-	conn            discovery.Discovery
-	mu              sync.RWMutex
-	srvMap          map[string]*discovery.Service
-	onSrvUpdate     discovery.OnSrvUpdatedFunc
-	unwatchSrvChMap map[string]chan struct{}
-	isWatched       bool
-	watchedServices map[string]struct{}
+	dir         string
+	conn        discovery.Discovery
+	mu          sync.RWMutex
+	srvMap      map[string]*discovery.Service
+	srvRevs     map[string]int64
+	onSrvUpdate discovery.OnSrvUpdatedFunc
+	watchers    *util.Watchers
+	// trackedSrvs are services kept up to date with their cache files, all services are kept once isLoadedAll
+	trackedSrvs map[string]struct{}
+	isLoadedAll bool
+	unwatchCh   chan struct{}
+	wg          sync.WaitGroup
+	isClosed    bool
+	closeOnce   sync.Once
+	revision    atomic.Int64
 }
 
 func (d *Discovery) LoadAll(_ context.Context) ([]*discovery.Service, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
 	files, err := os.ReadDir(d.dir)
 	if err != nil {
 		return nil, err
 	}
 
+	d.track("")
+
 	var services []*discovery.Service
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
 
-		fileName := file.Name()
-		if !strings.HasSuffix(fileName, ".json") {
+		srvName, ok := d.IsCacheFile(file.Name())
+		if !ok {
 			continue
 		}
 
-		suffixPos := strings.IndexByte(fileName, '.')
-		if suffixPos <= 0 {
-			continue
-		}
-
-		srvName := fileName[:suffixPos]
-
-		srv, err := d.getSrvFromLocalFile(srvName)
+		srv, rev, err := d.ReadCacheFile(d.dir, srvName)
 		if err != nil {
-			return nil, err
+			if err != discovery.ErrSrvNotFound && !errors.Is(err, discovery.ErrCacheFileCorrupted) {
+				return nil, err
+			}
+			log.Logger.Error(nil, err)
 		}
 
-		if _, ok := d.watchedServices[srvName]; !ok {
-			go func() {
-				if err = d.watchOne(srvName); err != nil {
-					log.Logger.Error(nil, err)
-					return
-				}
-			}()
+		if srv, _, ok = d.setSrv(srvName, srv, rev); !ok {
+			continue
 		}
 
-		d.srvMap[srvName] = srv
 		services = append(services, srv)
 	}
 
@@ -81,6 +81,18 @@ func (d *Discovery) Register(ctx context.Context, srvName string, node *discover
 	return d.conn.Register(ctx, srvName, node)
 }
 
+func (d *Discovery) RegisterWithLease(ctx context.Context, srvName string, node *discovery.Node, ttl time.Duration) error {
+	return d.conn.RegisterWithLease(ctx, srvName, node, ttl)
+}
+
+func (d *Discovery) Drain(ctx context.Context, srvName string, node *discovery.Node) error {
+	return d.conn.Drain(ctx, srvName, node)
+}
+
+func (d *Discovery) SetTrafficSplits(ctx context.Context, srvName string, splits []*discovery.TrafficSplit) error {
+	return d.conn.SetTrafficSplits(ctx, srvName, splits)
+}
+
 func (d *Discovery) Unregister(ctx context.Context, srvName string, node *discovery.Node, remove bool) error {
 	return d.conn.Unregister(ctx, srvName, node, remove)
 }
@@ -93,217 +105,401 @@ func (d *Discovery) getSrvFilePath(srvName string) string {
 	return d.FileCachedProxyContract.GetCacheFilePathBySrv(d.dir, srvName)
 }
 
-func (d *Discovery) getSrvFromLocalFile(srvName string) (*discovery.Service, error) {
-	filePath := d.getSrvFilePath(srvName)
-	fp, err := os.Open(filePath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
-		}
-		return nil, discovery.ErrSrvNotFound
-	}
-	defer fp.Close()
-	buf, err := io.ReadAll(fp)
+func (d *Discovery) Discover(ctx context.Context, srvName string, filters ...discovery.NodeFilter) (*discovery.Service, error) {
+	srv, err := d.discover(ctx, srvName)
 	if err != nil {
 		return nil, err
 	}
-	var srv discovery.Service
-	if len(buf) == 0 {
-		return nil, discovery.ErrSrvNotFound
-	}
-	err = json.Unmarshal(buf, &srv)
+	return discovery.FilterNodes(srv, filters...), nil
+}
+
+func (d *Discovery) discover(ctx context.Context, srvName string) (*discovery.Service, error) {
+	srv, before, err := d.load(ctx, srvName)
 	if err != nil {
 		return nil, err
 	}
-	return &srv, nil
+
+	if !reflect.DeepEqual(before, srv) {
+		d.notify(ctx, discovery.EvtUpdated, before, srv)
+	}
+
+	return srv, nil
 }
 
-func (d *Discovery) Discover(ctx context.Context, srvName string) (*discovery.Service, error) {
+// load returns srvName cached, or loads and caches it from its cache file, or from conn if the file is not
+// synced yet, which is replaced by the file once synced. before is the one cached before, nothing is notified.
+func (d *Discovery) load(ctx context.Context, srvName string) (srv, before *discovery.Service, err error) {
 	d.mu.RLock()
 	srv, ok := d.srvMap[srvName]
 	d.mu.RUnlock()
 	if ok {
-		return srv, nil
+		return srv, srv, nil
 	}
 
-	d.mu.Lock()
 	oneSrvMu := d.MakeOrGetOpOneSrvMu(srvName)
-	d.mu.Unlock()
 
 	oneSrvMu.Lock()
 	defer oneSrvMu.Unlock()
 
+	d.mu.RLock()
 	srv, ok = d.srvMap[srvName]
+	d.mu.RUnlock()
 	if ok {
-		return srv, nil
+		return srv, srv, nil
 	}
 
-	if _, ok = d.watchedServices[srvName]; !ok {
-		go func() {
-			if err := d.watchOne(srvName); err != nil {
-				log.Logger.Error(nil, err)
-				return
-			}
-		}()
-	}
+	d.track(srvName)
 
-	srv, err := d.getSrvFromLocalFile(srvName)
+	srv, rev, err := d.ReadCacheFile(d.dir, srvName)
 	if err != nil {
-		if err != discovery.ErrSrvNotFound {
-			return nil, err
+		if err != discovery.ErrSrvNotFound && !errors.Is(err, discovery.ErrCacheFileCorrupted) {
+			return nil, nil, err
 		}
 		srv, err = d.conn.Discover(ctx, srvName)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-	} else {
-		d.srvMap[srvName] = srv
+		rev = connRev
 	}
 
-	if d.onSrvUpdate != nil {
-		d.onSrvUpdate(ctx, discovery.EvtUpdated, srv)
-	}
+	srv, before, _ = d.setSrv(srvName, srv, rev)
 
-	return srv, nil
+	return srv, before, nil
 }
 
-func (d *Discovery) watchOne(srvName string) error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
+// setSrv caches srv read at rev and returns the one cached before. The cached one is kept and returned as the
+// current one if srv is nil or older than it, ok is false if nothing is cached at all.
+func (d *Discovery) setSrv(srvName string, srv *discovery.Service, rev int64) (cur, before *discovery.Service, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	before, ok = d.srvMap[srvName]
+	if srv == nil {
+		return before, before, ok
 	}
 
+	if ok && rev < d.srvRevs[srvName] {
+		log.Logger.Warnf(nil, "cache file of service %s at revision %d is older than the cached one at %d, ignored", srvName, rev, d.srvRevs[srvName])
+		return before, before, true
+	}
+
+	d.srvMap[srvName] = srv
+	d.srvRevs[srvName] = rev
+
+	return srv, before, true
+}
+
+func (d *Discovery) isFromConn(srvName string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	rev, ok := d.srvRevs[srvName]
+	return ok && rev == connRev
+}
+
+func (d *Discovery) delSrv(srvName string) *discovery.Service {
 	d.mu.Lock()
-	oneSrvMu := d.MakeOrGetOpOneSrvMu(srvName)
-	d.mu.Unlock()
+	defer d.mu.Unlock()
+	before := d.srvMap[srvName]
+	delete(d.srvMap, srvName)
+	delete(d.srvRevs, srvName)
+	return before
+}
 
-	oneSrvMu.RLock()
-	if _, ok := d.watchedServices[srvName]; ok {
-		oneSrvMu.RUnlock()
-		return nil
+// track keeps srvName up to date with its cache file from now on, all services are kept if srvName is empty.
+func (d *Discovery) track(srvName string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.isClosed {
+		return
 	}
-	oneSrvMu.RUnlock()
 
-	oneSrvMu.Lock()
-	if _, ok := d.watchedServices[srvName]; ok {
-		oneSrvMu.Unlock()
-		return nil
+	if srvName == "" {
+		d.isLoadedAll = true
+	} else {
+		d.trackedSrvs[srvName] = struct{}{}
 	}
-	d.watchedServices[srvName] = struct{}{}
-	oneSrvMu.Unlock()
 
-	filePath := d.getSrvFilePath(srvName)
+	if d.unwatchCh != nil {
+		return
+	}
 
-	var (
-		unwatchCh    = make(chan struct{})
-		watchSuccess bool
-	)
-	for {
-		if !watchSuccess {
-			err = watcher.Watch(filePath)
-			if err != nil {
-				log.Logger.Error(nil, err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
+	unwatchCh := make(chan struct{})
+	d.unwatchCh = unwatchCh
 
-			watchSuccess = true
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		if err := d.watchDir(unwatchCh); err != nil {
+			log.Logger.Error(nil, err)
+		}
+	}()
+}
 
-			d.unwatchSrvChMap[srvName] = unwatchCh
+func (d *Discovery) isTracked(srvName string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.trackedSrvs[srvName]
+	return ok || d.isLoadedAll
+}
 
-			oneSrvMu = d.MakeOrGetOpOneSrvMu(srvName)
-			oneSrvMu.Lock()
+// watchDir watches the cache directory with a single watcher and reloads services whose files are changed.
+func (d *Discovery) watchDir(unwatchCh chan struct{}) error {
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.unwatchCh == unwatchCh {
+			d.unwatchCh = nil
+		}
+	}()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
 
-			srv, err := d.getSrvFromLocalFile(srvName)
-			if err != nil {
-				delete(d.srvMap, srvName)
-				oneSrvMu.Unlock()
+	dir := filepath.Clean(d.dir)
+	for {
+		for {
+			if err = watcher.Watch(dir); err == nil {
+				break
+			}
 
+			if !os.IsNotExist(err) {
 				log.Logger.Error(nil, err)
-				continue
 			}
 
-			d.srvMap[srvName] = srv
-			oneSrvMu.Unlock()
+			select {
+			case <-unwatchCh:
+				return nil
+			case <-time.After(5 * time.Second):
+			}
 		}
 
-		select {
-		case <-unwatchCh:
-			goto out
-		case evt := <-watcher.Event:
-			if evt.IsDelete() || evt.IsRename() {
-				d.mu.Lock()
-				oneSrvMu = d.MakeOrGetOpOneSrvMu(srvName)
-				d.mu.Unlock()
-
-				oneSrvMu.Lock()
-				delete(d.srvMap, srvName)
-				oneSrvMu.Unlock()
-
-				if d.onSrvUpdate != nil {
-					d.onSrvUpdate(context.Background(), discovery.EvtDeleted, &discovery.Service{
-						SrvName: srvName,
-					})
+		// files may be changed before watched
+		d.reloadAll()
+
+	watchDir:
+		for {
+			select {
+			case <-unwatchCh:
+				return nil
+			case err = <-watcher.Error:
+				log.Logger.Error(nil, err)
+			case evt := <-watcher.Event:
+				if evt.Name == dir {
+					// wait until the directory created again
+					if evt.IsDelete() || evt.IsRename() {
+						break watchDir
+					}
+					continue
 				}
+
+				if evt.IsAttrib() {
+					continue
+				}
+
+				// temp files written aside by the proxy are skipped, their renames into place are seen as creations
+				srvName, ok := d.IsCacheFile(evt.Name)
+				if !ok || !d.isTracked(srvName) {
+					continue
+				}
+
+				d.reload(srvName)
 			}
+		}
+	}
+}
 
-			if evt.IsAttrib() {
+// reloadAll reloads all tracked services, including the ones cached without files anymore.
+func (d *Discovery) reloadAll() {
+	d.mu.RLock()
+	isLoadedAll := d.isLoadedAll
+	srvNames := make(map[string]struct{}, len(d.trackedSrvs)+len(d.srvMap))
+	for srvName := range d.trackedSrvs {
+		srvNames[srvName] = struct{}{}
+	}
+	for srvName := range d.srvMap {
+		srvNames[srvName] = struct{}{}
+	}
+	d.mu.RUnlock()
+
+	if isLoadedAll {
+		files, err := os.ReadDir(d.dir)
+		if err != nil {
+			log.Logger.Error(nil, err)
+		}
+		for _, file := range files {
+			if file.IsDir() {
 				continue
 			}
+			if srvName, ok := d.IsCacheFile(file.Name()); ok {
+				srvNames[srvName] = struct{}{}
+			}
+		}
+	}
 
-			d.mu.Lock()
-			oneSrvMu = d.MakeOrGetOpOneSrvMu(srvName)
-			d.mu.Unlock()
+	for srvName := range srvNames {
+		d.reload(srvName)
+	}
+}
 
-			oneSrvMu.Lock()
-			srv, err := d.getSrvFromLocalFile(srvName)
-			if err != nil {
-				delete(d.srvMap, srvName)
-				oneSrvMu.Unlock()
+// reload reads the cache file of srvName again, the service is deleted if the file is gone, and the last good one
+// is kept if it's torn or older.
+func (d *Discovery) reload(srvName string) {
+	oneSrvMu := d.MakeOrGetOpOneSrvMu(srvName)
 
-				log.Logger.Error(nil, err)
-				continue
-			}
-			d.srvMap[srvName] = srv
+	oneSrvMu.Lock()
+
+	if _, err := os.Stat(d.getSrvFilePath(srvName)); err != nil {
+		if !os.IsNotExist(err) {
 			oneSrvMu.Unlock()
+			log.Logger.Error(nil, err)
+			return
+		}
 
-			if d.onSrvUpdate != nil {
-				d.onSrvUpdate(context.Background(), discovery.EvtUpdated, srv)
-			}
+		// not synced yet rather than removed
+		if d.isFromConn(srvName) {
+			oneSrvMu.Unlock()
+			return
 		}
+
+		before := d.delSrv(srvName)
+		oneSrvMu.Unlock()
+
+		if before != nil {
+			d.notify(context.Background(), discovery.EvtDeleted, before, &discovery.Service{
+				SrvName: srvName,
+			})
+		}
+		return
 	}
-out:
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if _, ok := d.watchedServices[srvName]; ok {
-		return nil
+
+	srv, rev, err := d.ReadCacheFile(d.dir, srvName)
+	if err != nil {
+		oneSrvMu.Unlock()
+		// a file written in place is seen empty before written
+		if err != discovery.ErrSrvNotFound {
+			log.Logger.Error(nil, err)
+		}
+		return
+	}
+	srv, before, _ := d.setSrv(srvName, srv, rev)
+	oneSrvMu.Unlock()
+
+	// a write may be seen several times
+	if reflect.DeepEqual(before, srv) {
+		return
 	}
-	delete(d.unwatchSrvChMap, srvName)
-	delete(d.watchedServices, srvName)
-	return nil
+
+	d.notify(context.Background(), discovery.EvtUpdated, before, srv)
 }
 
 func (d *Discovery) OnSrvUpdated(fn discovery.OnSrvUpdatedFunc) {
 	d.onSrvUpdate = fn
 }
 
+func (d *Discovery) Watch(ctx context.Context, srvNames ...string) (<-chan *discovery.WatchEvt, error) {
+	return d.watchers.Watch(ctx, srvNames, func(ctx context.Context) ([]*discovery.WatchEvt, error) {
+		return util.LoadSnapshot(ctx, srvNames, d.snapshot, d.loadSnapshot)
+	})
+}
+
+// snapshot returns snapshots of all services at the revision counted so far, LoadAll notifies nothing.
+func (d *Discovery) snapshot(ctx context.Context) ([]*discovery.WatchEvt, error) {
+	revision := d.revision.Load()
+	services, err := d.LoadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*discovery.WatchEvt
+	for _, srv := range services {
+		snapshots = append(snapshots, util.NewSnapshot(srv, revision))
+	}
+
+	return snapshots, nil
+}
+
+// loadSnapshot returns the snapshot of srvName without notifying anyone, the new subscriber gets it only.
+func (d *Discovery) loadSnapshot(ctx context.Context, srvName string) (*discovery.WatchEvt, error) {
+	revision := d.revision.Load()
+	srv, _, err := d.load(ctx, srvName)
+	if err != nil {
+		return nil, err
+	}
+	return util.NewSnapshot(srv, revision), nil
+}
+
+// notify publishes the change from before to after, revisions of changes are counted by the Discovery itself
+// since deletions of cache files have none.
+func (d *Discovery) notify(ctx context.Context, evt discovery.Evt, before, after *discovery.Service) {
+	watchEvt := discovery.NewWatchEvt(evt, before, after, d.revision.Add(1))
+	if d.onSrvUpdate != nil {
+		d.onSrvUpdate(discovery.WithWatchEvt(ctx, watchEvt), evt, after)
+	}
+	d.watchers.Publish(watchEvt)
+}
+
+// Unwatch stops watching cache files and forgets the cached services, they are loaded and watched again by the
+// next LoadAll or Discover.
 func (d *Discovery) Unwatch() {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-	for _, unwatchCh := range d.unwatchSrvChMap {
-		unwatchCh <- struct{}{}
+	d.mu.Lock()
+	unwatchCh := d.unwatchCh
+	d.unwatchCh = nil
+	d.trackedSrvs = map[string]struct{}{}
+	d.isLoadedAll = false
+	d.srvMap = map[string]*discovery.Service{}
+	d.srvRevs = map[string]int64{}
+	d.mu.Unlock()
+
+	if unwatchCh != nil {
+		close(unwatchCh)
 	}
+
+	d.watchers.CloseAll()
+}
+
+// Close stops watching cache files and closes conn as well.
+func (d *Discovery) Close(ctx context.Context) error {
+	var err error
+	d.closeOnce.Do(func() {
+		d.mu.Lock()
+		d.isClosed = true
+		d.mu.Unlock()
+
+		d.Unwatch()
+
+		doneCh := make(chan struct{})
+		go func() {
+			d.wg.Wait()
+			close(doneCh)
+		}()
+
+		select {
+		case <-doneCh:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if closeErr := d.conn.Close(ctx); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
 }
 
 var _ discovery.Discovery = (*Discovery)(nil)
 
 func NewDiscovery(dir string, conn discovery.Discovery) discovery.Discovery {
 	discover := &Discovery{
-		dir:             dir,
-		conn:            conn,
-		srvMap:          map[string]*discovery.Service{},
-		unwatchSrvChMap: map[string]chan struct{}{},
-		watchedServices: map[string]struct{}{},
+		dir:         dir,
+		conn:        conn,
+		srvMap:      map[string]*discovery.Service{},
+		srvRevs:     map[string]int64{},
+		trackedSrvs: map[string]struct{}{},
+		watchers:    util.NewWatchers(),
 	}
 	discover.SpecSrvMuFactory = util.NewSpecSrvMuFactory()
 	return discover
@@ -0,0 +1,350 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/util"
+)
+
+// Discovery keeps services in process memory, it's designed for tests and local development.
+// OnSrvUpdated callbacks are called synchronously in order of changes, so they must not write to the same
+// Discovery again.
+type Discovery struct {
+	mu          sync.RWMutex
+	notifyMu    sync.Mutex
+	srvMap      map[string]*discovery.Service
+	onSrvUpdate discovery.OnSrvUpdatedFunc
+	watchers    *util.Watchers
+	isUnwatched bool
+	revision    int64
+	// refs counts handles of the Discovery got by GetOrNewShared, guarded by sharedDiscoveriesMu
+	refs int
+}
+
+func (d *Discovery) LoadAll(ctx context.Context) ([]*discovery.Service, error) {
+	d.notifyMu.Lock()
+	defer d.notifyMu.Unlock()
+
+	d.mu.Lock()
+	d.isUnwatched = false
+	var services []*discovery.Service
+	for _, srv := range d.srvMap {
+		services = append(services, srv)
+	}
+	onSrvUpdate := d.onSrvUpdate
+	revision := d.revision
+	d.mu.Unlock()
+
+	for _, srv := range services {
+		evt := discovery.NewWatchEvt(discovery.EvtUpdated, srv, srv, revision)
+		if onSrvUpdate != nil {
+			onSrvUpdate(discovery.WithWatchEvt(ctx, evt), evt.Evt, srv)
+		}
+		d.watchers.Publish(evt)
+	}
+
+	return services, nil
+}
+
+func (d *Discovery) Register(ctx context.Context, srvName string, node *discovery.Node) error {
+	if srvName == "" {
+		return errors.New("invalid serviceName, empty")
+	}
+
+	if node.Host == "" || node.Port == 0 {
+		return errors.New(fmt.Sprintf("invalid node, node %+v", node))
+	}
+
+	n := *node
+	if !n.Available() {
+		n.Status = discovery.NodeStateAlive
+	}
+
+	d.update(ctx, srvName, func(srv *discovery.Service) {
+		for i, old := range srv.Nodes {
+			if old.Host == n.Host && old.Port == n.Port {
+				srv.Nodes[i] = &n
+				return
+			}
+		}
+		srv.Nodes = append(srv.Nodes, &n)
+	})
+
+	return nil
+}
+
+// RegisterWithLease registers node as Register does, node never expires since the lease is kept alive by the
+// process holding the memory.
+func (d *Discovery) RegisterWithLease(ctx context.Context, srvName string, node *discovery.Node, _ time.Duration) error {
+	return d.Register(ctx, srvName, node)
+}
+
+func (d *Discovery) Unregister(ctx context.Context, srvName string, node *discovery.Node, remove bool) error {
+	if srvName == "" {
+		return errors.New("invalid serviceName, empty")
+	}
+
+	d.update(ctx, srvName, func(srv *discovery.Service) {
+		var remainedNodes []*discovery.Node
+		for _, old := range srv.Nodes {
+			if old.Host != node.Host || old.Port != node.Port {
+				remainedNodes = append(remainedNodes, old)
+				continue
+			}
+
+			if remove {
+				continue
+			}
+
+			n := *old
+			n.Status = discovery.NodeStateDead
+			n.Extra = node.Extra
+			remainedNodes = append(remainedNodes, &n)
+		}
+		srv.Nodes = remainedNodes
+	})
+
+	return nil
+}
+
+func (d *Discovery) Drain(ctx context.Context, srvName string, node *discovery.Node) error {
+	if srvName == "" {
+		return errors.New("invalid serviceName, empty")
+	}
+
+	d.update(ctx, srvName, func(srv *discovery.Service) {
+		for i, old := range srv.Nodes {
+			if old.Host != node.Host || old.Port != node.Port {
+				continue
+			}
+			n := *old
+			n.Status = discovery.NodeStateDraining
+			srv.Nodes[i] = &n
+		}
+	})
+
+	return nil
+}
+
+func (d *Discovery) UnregisterAll(ctx context.Context, srvName string) error {
+	if srvName == "" {
+		return errors.New("invalid serviceName, empty")
+	}
+
+	d.update(ctx, srvName, func(srv *discovery.Service) {
+		srv.Nodes = nil
+		srv.TrafficSplits = nil
+	})
+
+	return nil
+}
+
+func (d *Discovery) SetTrafficSplits(ctx context.Context, srvName string, splits []*discovery.TrafficSplit) error {
+	if srvName == "" {
+		return errors.New("invalid serviceName, empty")
+	}
+
+	if err := discovery.ValidateTrafficSplits(splits); err != nil {
+		return err
+	}
+
+	d.update(ctx, srvName, func(srv *discovery.Service) {
+		srv.TrafficSplits = splits
+	})
+
+	return nil
+}
+
+// update replaces service by the copy changed by fn, services are never changed in place so the ones handed
+// out before stay consistent. Service is deleted if it has neither nodes nor traffic splits after changed.
+func (d *Discovery) update(ctx context.Context, srvName string, fn func(srv *discovery.Service)) {
+	d.notifyMu.Lock()
+	defer d.notifyMu.Unlock()
+
+	d.mu.Lock()
+	srv := &discovery.Service{
+		SrvName: srvName,
+	}
+	old, existed := d.srvMap[srvName]
+	if existed {
+		srv.Nodes = make([]*discovery.Node, len(old.Nodes))
+		copy(srv.Nodes, old.Nodes)
+		srv.TrafficSplits = old.TrafficSplits
+	}
+
+	fn(srv)
+
+	evt := discovery.EvtUpdated
+	if len(srv.Nodes) == 0 && len(srv.TrafficSplits) == 0 {
+		if !existed {
+			d.mu.Unlock()
+			return
+		}
+		delete(d.srvMap, srvName)
+		evt = discovery.EvtDeleted
+		srv = &discovery.Service{
+			SrvName: srvName,
+		}
+	} else {
+		d.srvMap[srvName] = srv
+	}
+
+	d.revision++
+	watchEvt := discovery.NewWatchEvt(evt, old, srv, d.revision)
+	isUnwatched := d.isUnwatched
+	onSrvUpdate := d.onSrvUpdate
+	d.mu.Unlock()
+
+	if isUnwatched {
+		return
+	}
+
+	if onSrvUpdate != nil {
+		onSrvUpdate(discovery.WithWatchEvt(ctx, watchEvt), evt, srv)
+	}
+	d.watchers.Publish(watchEvt)
+}
+
+func (d *Discovery) Discover(ctx context.Context, srvName string, filters ...discovery.NodeFilter) (*discovery.Service, error) {
+	srv, err := d.discover(ctx, srvName)
+	if err != nil {
+		return nil, err
+	}
+	return discovery.FilterNodes(srv, filters...), nil
+}
+
+func (d *Discovery) discover(_ context.Context, srvName string) (*discovery.Service, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.isUnwatched = false
+
+	srv, ok := d.srvMap[srvName]
+	if !ok {
+		return nil, discovery.ErrSrvNotFound
+	}
+
+	return srv, nil
+}
+
+func (d *Discovery) OnSrvUpdated(fn discovery.OnSrvUpdatedFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onSrvUpdate = fn
+}
+
+func (d *Discovery) Watch(ctx context.Context, srvNames ...string) (<-chan *discovery.WatchEvt, error) {
+	return d.watchers.Watch(ctx, srvNames, func(ctx context.Context) ([]*discovery.WatchEvt, error) {
+		return util.LoadSnapshot(ctx, srvNames, d.snapshot, d.loadSnapshot)
+	})
+}
+
+// snapshot returns snapshots of all services at the current revision without notifying anyone.
+func (d *Discovery) snapshot(_ context.Context) ([]*discovery.WatchEvt, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.isUnwatched = false
+	var snapshots []*discovery.WatchEvt
+	for _, srv := range d.srvMap {
+		snapshots = append(snapshots, util.NewSnapshot(srv, d.revision))
+	}
+
+	return snapshots, nil
+}
+
+func (d *Discovery) loadSnapshot(_ context.Context, srvName string) (*discovery.WatchEvt, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.isUnwatched = false
+
+	srv, ok := d.srvMap[srvName]
+	if !ok {
+		return nil, discovery.ErrSrvNotFound
+	}
+
+	return util.NewSnapshot(srv, d.revision), nil
+}
+
+// Unwatch closes all subscriptions of Watch and stops calling OnSrvUpdated callbacks until the next LoadAll
+// or Discover.
+func (d *Discovery) Unwatch() {
+	d.mu.Lock()
+	d.isUnwatched = true
+	d.mu.Unlock()
+	d.watchers.CloseAll()
+}
+
+// Close closes all subscriptions as Unwatch does, services are kept.
+func (d *Discovery) Close(_ context.Context) error {
+	d.Unwatch()
+	return nil
+}
+
+var _ discovery.Discovery = (*Discovery)(nil)
+
+func NewDiscovery() discovery.Discovery {
+	return newDiscovery()
+}
+
+func newDiscovery() *Discovery {
+	return &Discovery{
+		srvMap:   map[string]*discovery.Service{},
+		watchers: util.NewWatchers(),
+	}
+}
+
+var (
+	sharedDiscoveries   = map[string]*Discovery{}
+	sharedDiscoveriesMu sync.Mutex
+)
+
+// GetOrNewShared returns a handle of the Discovery shared by the whole process for keyPrefix, so servers
+// registered and clients resolving through different handles in the same process see the same services. Every
+// handle holds a reference released once by its Close, the shared one is unwatched once all handles closed.
+func GetOrNewShared(keyPrefix string) discovery.Discovery {
+	sharedDiscoveriesMu.Lock()
+	defer sharedDiscoveriesMu.Unlock()
+
+	discover, ok := sharedDiscoveries[keyPrefix]
+	if !ok {
+		discover = newDiscovery()
+		sharedDiscoveries[keyPrefix] = discover
+	}
+	discover.refs++
+
+	return &sharedHandle{
+		Discovery: discover,
+	}
+}
+
+type sharedHandle struct {
+	*Discovery
+	closeOnce sync.Once
+}
+
+func (h *sharedHandle) Close(ctx context.Context) error {
+	var err error
+	h.closeOnce.Do(func() {
+		if releaseShared(h.Discovery) {
+			err = h.Discovery.Close(ctx)
+		}
+	})
+	return err
+}
+
+// releaseShared releases a reference of the shared d, it reports whether d is released by all handles.
+func releaseShared(d *Discovery) bool {
+	sharedDiscoveriesMu.Lock()
+	defer sharedDiscoveriesMu.Unlock()
+
+	d.refs--
+
+	return d.refs == 0
+}
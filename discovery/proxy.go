@@ -1,9 +1,36 @@
 package discovery
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
 const (
 	FileCachedProxyProtoFileExt = ".json"
+	// CacheFileVersion is the version of CacheFile written by the current proxy.
+	CacheFileVersion = 1
 )
 
+var ErrCacheFileCorrupted = errors.New("cache file corrupted")
+
+// CacheFile is the envelope of a service in its cache file. Checksum is the hex sha256 of Srv, so a torn file is
+// detected even if it happens to be valid JSON.
+type CacheFile struct {
+	Version int `json:"version"`
+	// Revision is the revision of discovery Srv is loaded at, readers never go back to older ones.
+	Revision  int64           `json:"revision"`
+	WrittenAt int64           `json:"written_at"`
+	Checksum  string          `json:"checksum"`
+	Srv       json.RawMessage `json:"srv"`
+}
+
 // FileCachedProxyContract file cache proxy system is designed to cache remote discovery by used local file system.
 // Provide capacity of accessing handler config in high performance and alleviate workload of remote discovery and
 // also get HA(local file could be instead of remote discovery in temporary while remote discovery died).
@@ -14,3 +41,111 @@ type FileCachedProxyContract struct {
 func (*FileCachedProxyContract) GetCacheFilePathBySrv(dir, srvName string) string {
 	return dir + "/" + srvName + FileCachedProxyProtoFileExt
 }
+
+// WriteCacheFile writes srv loaded at revision into its cache file in dir. The file is written aside and renamed
+// into place, so readers see either the old file or the new one as a whole.
+func (c *FileCachedProxyContract) WriteCacheFile(dir string, srv *Service, revision int64) error {
+	srvJson, err := json.Marshal(srv)
+	if err != nil {
+		return err
+	}
+
+	checksum := sha256.Sum256(srvJson)
+	fileJson, err := json.Marshal(&CacheFile{
+		Version:   CacheFileVersion,
+		Revision:  revision,
+		WrittenAt: time.Now().UnixMilli(),
+		Checksum:  hex.EncodeToString(checksum[:]),
+		Srv:       srvJson,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the name starts with a dot and has no FileCachedProxyProtoFileExt, it's never taken as a cache file
+	fp, err := os.CreateTemp(dir, "."+srv.SrvName+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := fp.Name()
+	if _, err = fp.Write(fileJson); err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0666)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, c.GetCacheFilePathBySrv(dir, srv.SrvName))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// ReadCacheFile reads srvName from its cache file in dir and returns the revision it's loaded at. Files written
+// before CacheFile was introduced are read as revision 0. It returns ErrSrvNotFound if there is no such file, and
+// ErrCacheFileCorrupted if the file is torn.
+func (c *FileCachedProxyContract) ReadCacheFile(dir, srvName string) (*Service, int64, error) {
+	fp, err := os.Open(c.GetCacheFilePathBySrv(dir, srvName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, 0, err
+		}
+		return nil, 0, ErrSrvNotFound
+	}
+	defer fp.Close()
+
+	buf, err := io.ReadAll(fp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(buf) == 0 {
+		return nil, 0, ErrSrvNotFound
+	}
+
+	var file CacheFile
+	if err = json.Unmarshal(buf, &file); err != nil {
+		return nil, 0, fmt.Errorf("%w, file of service %s, err:%s", ErrCacheFileCorrupted, srvName, err)
+	}
+
+	srvJson := buf
+	if file.Version > 0 {
+		if file.Version > CacheFileVersion {
+			return nil, 0, fmt.Errorf("unsupported version %d of cache file of service %s", file.Version, srvName)
+		}
+
+		checksum := sha256.Sum256(file.Srv)
+		if hex.EncodeToString(checksum[:]) != file.Checksum {
+			return nil, 0, fmt.Errorf("%w, checksum of service %s mismatched", ErrCacheFileCorrupted, srvName)
+		}
+
+		srvJson = file.Srv
+	}
+
+	var srv Service
+	if err = json.Unmarshal(srvJson, &srv); err != nil {
+		return nil, 0, fmt.Errorf("%w, file of service %s, err:%s", ErrCacheFileCorrupted, srvName, err)
+	}
+
+	return &srv, file.Revision, nil
+}
+
+// IsCacheFile reports whether fileName is a cache file and which service it caches.
+func (*FileCachedProxyContract) IsCacheFile(fileName string) (srvName string, ok bool) {
+	fileName = filepath.Base(fileName)
+	if len(fileName) <= len(FileCachedProxyProtoFileExt) || fileName[0] == '.' {
+		return "", false
+	}
+	if filepath.Ext(fileName) != FileCachedProxyProtoFileExt {
+		return "", false
+	}
+	return fileName[:len(fileName)-len(FileCachedProxyProtoFileExt)], true
+}
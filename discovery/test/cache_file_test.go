@@ -0,0 +1,136 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/filecachedproxy"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+)
+
+func TestCacheFile(t *testing.T) {
+	dir := t.TempDir()
+
+	var contract discovery.FileCachedProxyContract
+	filePath := contract.GetCacheFilePathBySrv(dir, "logv3")
+
+	writeNodes := func(revision int64, nodes ...*discovery.Node) {
+		t.Helper()
+		if err := contract.WriteCacheFile(dir, &discovery.Service{SrvName: "logv3", Nodes: nodes}, revision); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node1, node2 := discovery.NewNode("127.2.1.1", 12014), discovery.NewNode("127.2.1.1", 12015)
+	writeNodes(5, node1)
+
+	srv, revision, err := contract.ReadCacheFile(dir, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision != 5 || len(srv.Nodes) != 1 {
+		t.Fatalf("unexpected service %+v at revision %d", srv, revision)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expect only the cache file left, got %+v", entries)
+	}
+
+	discover := filecachedproxy.NewDiscovery(dir, memory.NewDiscovery())
+	defer discover.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evtCh, err := discover.Watch(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvWatchEvt(t, evtCh)
+
+	// a torn file and an older one never replace the last good one
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filePath, buf[:len(buf)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = contract.ReadCacheFile(dir, "logv3"); !errors.Is(err, discovery.ErrCacheFileCorrupted) {
+		t.Fatalf("expect ErrCacheFileCorrupted, got %v", err)
+	}
+	writeNodes(3)
+
+	writeNodes(6, node1, node2)
+
+	evt := recvWatchEvt(t, evtCh)
+	if len(evt.Srv.Nodes) != 2 || len(evt.Diff.Added) != 1 {
+		t.Fatalf("unexpected event %+v of nodes %+v", evt, evt.Srv.Nodes)
+	}
+
+	srv, err = discover.Discover(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Nodes) != 2 {
+		t.Fatalf("unexpected nodes %+v", srv.Nodes)
+	}
+}
+
+func TestFileCachedProxyWatchDir(t *testing.T) {
+	dir := t.TempDir()
+
+	var contract discovery.FileCachedProxyContract
+	writeSrv := func(srvName string, revision int64, nodes ...*discovery.Node) {
+		t.Helper()
+		if err := contract.WriteCacheFile(dir, &discovery.Service{SrvName: srvName, Nodes: nodes}, revision); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node := discovery.NewNode("127.2.1.1", 12014)
+	writeSrv("logv3", 1, node)
+
+	discover := filecachedproxy.NewDiscovery(dir, memory.NewDiscovery())
+	defer discover.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evtCh, err := discover.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt := recvWatchEvt(t, evtCh); evt.Srv.SrvName != "logv3" {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+
+	// services created after loaded are picked up
+	writeSrv("logv4", 1, node)
+	if evt := recvWatchEvt(t, evtCh); evt.Evt != discovery.EvtUpdated || evt.Srv.SrvName != "logv4" {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+
+	writeSrv("logv3", 2, node, discovery.NewNode("127.2.1.1", 12015))
+	if evt := recvWatchEvt(t, evtCh); evt.Evt != discovery.EvtUpdated || evt.Srv.SrvName != "logv3" || len(evt.Diff.Added) != 1 {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+
+	if err = os.Remove(contract.GetCacheFilePathBySrv(dir, "logv4")); err != nil {
+		t.Fatal(err)
+	}
+	if evt := recvWatchEvt(t, evtCh); evt.Evt != discovery.EvtDeleted || evt.Srv.SrvName != "logv4" {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+
+	if _, err = discover.Discover(ctx, "logv4"); err != discovery.ErrSrvNotFound {
+		t.Fatalf("expect ErrSrvNotFound, got %v", err)
+	}
+}
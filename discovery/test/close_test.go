@@ -0,0 +1,150 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/etcd"
+	"github.com/995933447/microgosuit/discovery/impl/filecachedproxy"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// checkGoroutineLeak returns a func failing t if goroutines started since called are still running.
+func checkGoroutineLeak(t *testing.T) func() {
+	t.Helper()
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				t.Fatalf("goroutines leaked, %d before, %d after\n%s", before, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// useAndClose makes discover start its background work, then closes it twice.
+func useAndClose(t *testing.T, discover discovery.Discovery) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	srv, err := discover.Discover(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Nodes) != 1 {
+		t.Fatalf("unexpected nodes %+v", srv.Nodes)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	evtCh, err := discover.Watch(watchCtx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvWatchEvt(t, evtCh)
+
+	for i := 0; i < 2; i++ {
+		if err = discover.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case _, ok := <-evtCh:
+		if ok {
+			t.Fatal("expect channel closed after closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after closed")
+	}
+}
+
+func TestMemoryClose(t *testing.T) {
+	checkLeak := checkGoroutineLeak(t)
+
+	discover := memory.NewDiscovery()
+	if err := discover.Register(context.Background(), "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+
+	useAndClose(t, discover)
+
+	checkLeak()
+}
+
+func TestEtcdClose(t *testing.T) {
+	checkLeak := checkGoroutineLeak(t)
+
+	etcdCfg := clientv3.Config{
+		Endpoints:   []string{"127.0.0.1:12379"},
+		DialTimeout: time.Second,
+	}
+
+	keyPrefix := "/microgosuit_test/" + t.Name()
+	discover, err := etcd.NewDiscovery(keyPrefix, 3*time.Second, etcdCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// never watched yet
+	discover.Unwatch()
+
+	ctx := context.Background()
+
+	if err = discover.RegisterWithLease(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014), 0); err != nil {
+		_ = discover.Close(ctx)
+		t.Skipf("etcd unavailable, err:%s", err)
+	}
+	defer func() {
+		cli, err := clientv3.New(etcdCfg)
+		if err != nil {
+			return
+		}
+		_, _ = cli.Delete(ctx, keyPrefix, clientv3.WithPrefix())
+		_ = cli.Close()
+	}()
+
+	useAndClose(t, discover)
+
+	if err = discover.RegisterWithLease(ctx, "logv3", discovery.NewNode("127.2.1.1", 12015), 0); err == nil {
+		t.Fatal("expect registering with lease failed after closed")
+	}
+
+	checkLeak()
+}
+
+func TestFileCachedProxyClose(t *testing.T) {
+	checkLeak := checkGoroutineLeak(t)
+
+	dir := t.TempDir()
+
+	srvJson, err := json.Marshal(&discovery.Service{
+		SrvName: "logv3",
+		Nodes:   []*discovery.Node{discovery.NewNode("127.2.1.1", 12014)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var contract discovery.FileCachedProxyContract
+	if err = os.WriteFile(contract.GetCacheFilePathBySrv(dir, "logv3"), srvJson, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	discover := filecachedproxy.NewDiscovery(dir, memory.NewDiscovery())
+
+	useAndClose(t, discover)
+
+	checkLeak()
+}
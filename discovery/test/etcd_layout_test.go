@@ -0,0 +1,81 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/etcd"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdMigrateSrvKeys(t *testing.T) {
+	discover, _, _ := newFaultyEtcdDiscovery(t)
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{"127.0.0.1:12379"},
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	legacy, err := etcd.NewDiscovery(discover.KeyPrefix, 3*time.Second, clientv3.Config{}, etcd.WithClient(cli), etcd.WithLayout(etcd.LayoutSrvKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close(context.Background())
+
+	ctx := context.Background()
+
+	for _, port := range []int{12014, 12015, 12016} {
+		if err = legacy.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evtCh, err := discover.Watch(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return len(evt.Srv.Nodes) == 3
+	})
+
+	// nodes only in the service key are still changed by the node key layout
+	if err = discover.Drain(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return len(evt.Srv.Nodes) == 3 && evt.Srv.Nodes[0].Status == discovery.NodeStateDraining
+	})
+
+	if err = discover.MigrateSrvKeys(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := cli.Get(ctx, discover.KeyPrefix+"logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 0 {
+		t.Fatalf("expect service key removed, got %s", resp.Kvs[0].Value)
+	}
+
+	if err = discover.Unregister(ctx, "logv3", discovery.NewNode("127.2.1.1", 12015), true); err != nil {
+		t.Fatal(err)
+	}
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return len(evt.Srv.Nodes) == 2
+	})
+
+	srv, err := discover.Discover(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Nodes[0].Port != 12014 || srv.Nodes[0].Status != discovery.NodeStateDraining || srv.Nodes[1].Port != 12016 {
+		t.Fatalf("unexpected nodes after migrated, %+v %+v", srv.Nodes[0], srv.Nodes[1])
+	}
+}
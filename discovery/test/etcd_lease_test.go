@@ -0,0 +1,117 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/etcd"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdLease(t *testing.T) {
+	observer, _, _ := newFaultyEtcdDiscovery(t)
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{"127.0.0.1:12379"},
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	registrar, err := etcd.NewDiscovery(observer.KeyPrefix, 3*time.Second, clientv3.Config{}, etcd.WithClient(cli))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registrar.Close(context.Background())
+
+	ctx := context.Background()
+
+	if err = registrar.RegisterWithLease(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014), 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	evtCh, err := observer.Watch(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return evt.Evt == discovery.EvtUpdated && len(evt.Srv.Nodes) == 1
+	})
+
+	getLease := func() clientv3.LeaseID {
+		resp, err := cli.Get(ctx, observer.KeyPrefix+"logv3/", clientv3.WithPrefix())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) != 1 {
+			t.Fatalf("expect one node key, got %d", len(resp.Kvs))
+		}
+		return clientv3.LeaseID(resp.Kvs[0].Lease)
+	}
+
+	// the node is put again once its lease lost
+	leaseId := getLease()
+	if _, err = cli.Revoke(ctx, leaseId); err != nil {
+		t.Fatal(err)
+	}
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return evt.Evt == discovery.EvtDeleted
+	})
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return evt.Evt == discovery.EvtUpdated && len(evt.Srv.Nodes) == 1
+	})
+	if getLease() == leaseId {
+		t.Fatal("expect a new lease granted")
+	}
+
+	// the node expires once the lease is no longer kept alive
+	if err = registrar.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return evt.Evt == discovery.EvtDeleted
+	})
+
+	if _, err = observer.Discover(ctx, "logv3"); err != discovery.ErrSrvNotFound {
+		t.Fatalf("expect ErrSrvNotFound, got %v", err)
+	}
+}
+
+func TestEtcdLeaseOnSrvKey(t *testing.T) {
+	observer, _, _ := newFaultyEtcdDiscovery(t)
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{"127.0.0.1:12379"},
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	legacy, err := etcd.NewDiscovery(observer.KeyPrefix, 3*time.Second, clientv3.Config{}, etcd.WithClient(cli), etcd.WithLayout(etcd.LayoutSrvKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close(context.Background())
+
+	ctx := context.Background()
+
+	if err = legacy.RegisterWithLease(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014), 2*time.Second); !errors.Is(err, etcd.ErrLeaseOnSrvKey) {
+		t.Fatalf("expect ErrLeaseOnSrvKey, got %v", err)
+	}
+
+	// nothing is written by the refused registration
+	resp, err := cli.Get(ctx, observer.KeyPrefix+"logv3", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 0 {
+		t.Fatalf("expect no keys written, got %d", len(resp.Kvs))
+	}
+}
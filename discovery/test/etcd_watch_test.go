@@ -0,0 +1,296 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/etcd"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// faultyWatcher breaks watches or drops their events on demand.
+type faultyWatcher struct {
+	clientv3.Watcher
+	mu       sync.Mutex
+	breakChs []chan *clientv3.WatchResponse
+	dropping atomic.Bool
+}
+
+func (w *faultyWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	inCh := w.Watcher.Watch(ctx, key, opts...)
+	outCh := make(chan clientv3.WatchResponse)
+	breakCh := make(chan *clientv3.WatchResponse, 1)
+
+	w.mu.Lock()
+	w.breakChs = append(w.breakChs, breakCh)
+	w.mu.Unlock()
+
+	go func() {
+		defer close(outCh)
+		for {
+			select {
+			case resp, ok := <-inCh:
+				if !ok {
+					return
+				}
+				if w.dropping.Load() && len(resp.Events) > 0 {
+					continue
+				}
+				select {
+				case outCh <- resp:
+				case <-ctx.Done():
+					return
+				}
+			case resp := <-breakCh:
+				if resp != nil {
+					select {
+					case outCh <- *resp:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+		}
+	}()
+
+	return outCh
+}
+
+// breakAll closes all watches after delivering resp if it's not nil.
+func (w *faultyWatcher) breakAll(resp *clientv3.WatchResponse) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, breakCh := range w.breakChs {
+		breakCh <- resp
+	}
+	w.breakChs = nil
+}
+
+func newFaultyEtcdDiscovery(t *testing.T) (*etcd.Discovery, *faultyWatcher, <-chan etcd.WatchHealth) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{"127.0.0.1:12379"},
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cli.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err = cli.Get(ctx, "health"); err != nil {
+		t.Skipf("etcd unavailable, err:%s", err)
+	}
+
+	keyPrefix := fmt.Sprintf("/microgosuit_test/%s/%d", t.Name(), time.Now().UnixNano())
+	t.Cleanup(func() {
+		_, _ = cli.Delete(context.Background(), keyPrefix, clientv3.WithPrefix())
+	})
+
+	fw := &faultyWatcher{Watcher: cli.Watcher}
+	cli.Watcher = fw
+
+	healthCh := make(chan etcd.WatchHealth, 100)
+	discover, err := etcd.NewDiscovery(keyPrefix, 3*time.Second, clientv3.Config{}, etcd.WithClient(cli), etcd.WithWatchHealthHook(func(health etcd.WatchHealth) {
+		healthCh <- health
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = discover.Close(context.Background())
+	})
+
+	return discover.(*etcd.Discovery), fw, healthCh
+}
+
+func waitWatchHealth(t *testing.T, healthCh <-chan etcd.WatchHealth, healthy bool) etcd.WatchHealth {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case health := <-healthCh:
+			if health.Healthy == healthy {
+				return health
+			}
+		case <-timeout:
+			t.Fatalf("wait watch health %v timeout", healthy)
+		}
+	}
+}
+
+func waitWatchEvt(t *testing.T, evtCh <-chan *discovery.WatchEvt, match func(evt *discovery.WatchEvt) bool) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case evt, ok := <-evtCh:
+			if !ok {
+				t.Fatal("watch channel closed")
+			}
+			if match(evt) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("wait watch event timeout")
+		}
+	}
+}
+
+func TestEtcdWatchResume(t *testing.T) {
+	discover, fw, healthCh := newFaultyEtcdDiscovery(t)
+
+	ctx := context.Background()
+
+	if err := discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+
+	evtCh, err := discover.Watch(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return len(evt.Srv.Nodes) == 1
+	})
+	waitWatchHealth(t, healthCh, true)
+
+	fw.breakAll(nil)
+
+	if err = discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12015)); err != nil {
+		t.Fatal(err)
+	}
+
+	health := waitWatchHealth(t, healthCh, false)
+	if health.LastErr == nil {
+		t.Fatal("expect the error broke the watch reported")
+	}
+
+	// the change made while broken is delivered once resumed
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return evt.Evt == discovery.EvtUpdated && len(evt.Srv.Nodes) == 2
+	})
+	waitWatchHealth(t, healthCh, true)
+
+	if health = discover.WatchHealth(); !health.Healthy || health.Resyncs != 0 {
+		t.Fatalf("unexpected health %+v", health)
+	}
+}
+
+func TestEtcdWatchCompacted(t *testing.T) {
+	discover, fw, healthCh := newFaultyEtcdDiscovery(t)
+
+	ctx := context.Background()
+
+	for _, srvName := range []string{"logv3", "logv4"} {
+		if err := discover.Register(ctx, srvName, discovery.NewNode("127.2.1.1", 12014)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evtCh, err := discover.Watch(ctx, "logv3", "logv4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+			return evt.Evt == discovery.EvtUpdated
+		})
+	}
+	waitWatchHealth(t, healthCh, true)
+
+	// changes missed by the watch, as if they were compacted before delivered
+	fw.dropping.Store(true)
+	if err = discover.UnregisterAll(ctx, "logv3"); err != nil {
+		t.Fatal(err)
+	}
+	if err = discover.Register(ctx, "logv4", discovery.NewNode("127.2.1.1", 12015)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	fw.dropping.Store(false)
+
+	fw.breakAll(&clientv3.WatchResponse{CompactRevision: 1, Canceled: true})
+
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return evt.Evt == discovery.EvtDeleted && evt.Srv.SrvName == "logv3"
+	})
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return evt.Evt == discovery.EvtUpdated && evt.Srv.SrvName == "logv4" && len(evt.Srv.Nodes) == 2
+	})
+
+	health := waitWatchHealth(t, healthCh, true)
+	if health.Resyncs != 1 {
+		t.Fatalf("expect resynced once, got health %+v", health)
+	}
+
+	if _, err = discover.Discover(ctx, "logv3"); err != discovery.ErrSrvNotFound {
+		t.Fatalf("expect ErrSrvNotFound, got %v", err)
+	}
+}
+
+func TestEtcdWatchDiff(t *testing.T) {
+	discover, _, _ := newFaultyEtcdDiscovery(t)
+	checkDiff(t, discover, registerChanges(t, discover)...)
+}
+
+func TestEtcdWatchRecreated(t *testing.T) {
+	discover, _, _ := newFaultyEtcdDiscovery(t)
+
+	evtCh := make(chan *discovery.WatchEvt, 100)
+	discover.OnSrvUpdated(func(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {
+		evtCh <- &discovery.WatchEvt{Evt: evt, Srv: srv}
+	})
+
+	ctx := context.Background()
+
+	// the watch is opened by a service not found
+	if _, err := discover.Discover(ctx, "logv3"); err != discovery.ErrSrvNotFound {
+		t.Fatalf("expect ErrSrvNotFound, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+			t.Fatal(err)
+		}
+		waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+			return evt.Evt == discovery.EvtUpdated && evt.Srv.SrvName == "logv3" && len(evt.Srv.Nodes) == 1
+		})
+
+		if err := discover.UnregisterAll(ctx, "logv3"); err != nil {
+			t.Fatal(err)
+		}
+		waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+			return evt.Evt == discovery.EvtDeleted && evt.Srv.SrvName == "logv3"
+		})
+	}
+
+	if err := discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12015)); err != nil {
+		t.Fatal(err)
+	}
+	waitWatchEvt(t, evtCh, func(evt *discovery.WatchEvt) bool {
+		return evt.Evt == discovery.EvtUpdated && len(evt.Srv.Nodes) == 1 && evt.Srv.Nodes[0].Port == 12015
+	})
+
+	srv, err := discover.Discover(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Nodes) != 1 || srv.Nodes[0].Port != 12015 {
+		t.Fatalf("unexpected nodes %+v", srv.Nodes)
+	}
+}
+
+func TestEtcdWatchSnapshot(t *testing.T) {
+	discover, _, _ := newFaultyEtcdDiscovery(t)
+	checkWatchSnapshot(t, discover)
+}
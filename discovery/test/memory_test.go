@@ -0,0 +1,154 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+)
+
+func TestMemoryDiscovery(t *testing.T) {
+	discover := memory.NewDiscovery()
+
+	type evtRecord struct {
+		evt      discovery.Evt
+		srvName  string
+		nodesNum int
+	}
+	var evtRecords []evtRecord
+	discover.OnSrvUpdated(func(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {
+		evtRecords = append(evtRecords, evtRecord{
+			evt:      evt,
+			srvName:  srv.SrvName,
+			nodesNum: len(srv.Nodes),
+		})
+	})
+
+	ctx := context.Background()
+
+	if _, err := discover.Discover(ctx, "logv3"); err != discovery.ErrSrvNotFound {
+		t.Fatalf("expect ErrSrvNotFound, got %v", err)
+	}
+
+	if err := discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12013)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := discover.Register(ctx, "logv3", &discovery.Node{Host: "127.2.1.1", Port: 12013, Extra: "again"}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := discover.Discover(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(srv.Nodes) != 2 || srv.Nodes[1].Extra != "again" {
+		t.Fatalf("unexpected nodes %+v", srv.Nodes)
+	}
+
+	if err = discover.Unregister(ctx, "logv3", srv.Nodes[0], false); err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.Nodes[0].Status != discovery.NodeStateNil {
+		t.Fatal("service handed out before changed in place")
+	}
+
+	srv, err = discover.Discover(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if srv.Nodes[0].Available() {
+		t.Fatalf("expect node %+v dead", srv.Nodes[0])
+	}
+
+	services, err := discover.LoadAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(services) != 1 || services[0].SrvName != "logv3" {
+		t.Fatalf("unexpected services %+v", services)
+	}
+
+	if err = discover.UnregisterAll(ctx, "logv3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = discover.Discover(ctx, "logv3"); err != discovery.ErrSrvNotFound {
+		t.Fatalf("expect ErrSrvNotFound, got %v", err)
+	}
+
+	expectedEvtRecords := []evtRecord{
+		{discovery.EvtUpdated, "logv3", 1},
+		{discovery.EvtUpdated, "logv3", 2},
+		{discovery.EvtUpdated, "logv3", 2},
+		{discovery.EvtUpdated, "logv3", 2},
+		{discovery.EvtUpdated, "logv3", 2},
+		{discovery.EvtDeleted, "logv3", 0},
+	}
+	if len(evtRecords) != len(expectedEvtRecords) {
+		t.Fatalf("expect events %+v, got %+v", expectedEvtRecords, evtRecords)
+	}
+	for i, record := range evtRecords {
+		if record != expectedEvtRecords[i] {
+			t.Fatalf("expect events %+v, got %+v", expectedEvtRecords, evtRecords)
+		}
+	}
+
+	discover.Unwatch()
+	if err = discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+	if len(evtRecords) != len(expectedEvtRecords) {
+		t.Fatal("got event after unwatched")
+	}
+}
+
+func TestDiscoverFilter(t *testing.T) {
+	discover := memory.NewDiscovery()
+
+	ctx := context.Background()
+
+	nodes := []*discovery.Node{
+		{Host: "127.2.1.1", Port: 12014, Zone: "z1", Version: "v1", Labels: map[string]string{"lane": "blue"}},
+		{Host: "127.2.1.1", Port: 12015, Zone: "z2", Version: "v1"},
+		{Host: "127.2.1.1", Port: 12016, Zone: "z1", Version: "v2"},
+	}
+	for _, node := range nodes {
+		if err := discover.Register(ctx, "logv3", node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv, err := discover.Discover(ctx, "logv3", discovery.InZone("z1"), discovery.OfVersion("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Nodes) != 1 || srv.Nodes[0].Port != 12014 {
+		t.Fatalf("unexpected nodes %+v", srv.Nodes)
+	}
+
+	srv, err = discover.Discover(ctx, "logv3", discovery.LabelsMatch(map[string]string{"lane": "blue"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Nodes) != 1 || srv.Nodes[0].Label("lane") != "blue" {
+		t.Fatalf("unexpected nodes %+v", srv.Nodes)
+	}
+
+	srv, err = discover.Discover(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Nodes) != 3 {
+		t.Fatalf("filters changed nodes in discovery, got %+v", srv.Nodes)
+	}
+}
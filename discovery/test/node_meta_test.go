@@ -0,0 +1,63 @@
+package test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+)
+
+// checkNodeMeta checks metadata of nodes registered is discovered as is.
+func checkNodeMeta(t *testing.T, discover discovery.Discovery) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	node := discovery.NewNode("127.2.1.1", 12014)
+	node.Labels = map[string]string{discovery.LabelLane: "blue", "idc": "sz"}
+	node.Zone = "z1"
+	node.Version = "v2"
+	node.StartedAt = time.Now().Unix()
+	if err := discover.Register(ctx, "logv3", node); err != nil {
+		t.Fatal(err)
+	}
+
+	// a node without metadata gets none
+	if err := discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12015)); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := discover.Discover(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Nodes) != 2 {
+		t.Fatalf("unexpected nodes %+v", srv.Nodes)
+	}
+	for _, got := range srv.Nodes {
+		if got.Port != node.Port {
+			if len(got.Labels) != 0 || got.Zone != "" || got.Version != "" || got.StartedAt != 0 {
+				t.Fatalf("expect no metadata, got node %+v", got)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got.Labels, node.Labels) || got.Zone != node.Zone || got.Version != node.Version || got.StartedAt != node.StartedAt {
+			t.Fatalf("expect metadata of node %+v, got %+v", node, got)
+		}
+		if lane := got.Label(discovery.LabelLane); lane != "blue" {
+			t.Fatalf("expect lane blue, got %s", lane)
+		}
+	}
+}
+
+func TestMemoryNodeMeta(t *testing.T) {
+	checkNodeMeta(t, memory.NewDiscovery())
+}
+
+func TestEtcdNodeMeta(t *testing.T) {
+	discover, _, _ := newFaultyEtcdDiscovery(t)
+	checkNodeMeta(t, discover)
+}
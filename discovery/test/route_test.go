@@ -0,0 +1,354 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/util"
+)
+
+// pickPorts picks n times by pick and returns the ports picked.
+func pickPorts(t *testing.T, n int, pick func() (*discovery.Node, error)) map[int]int {
+	t.Helper()
+	picked := map[int]int{}
+	for i := 0; i < n; i++ {
+		node, err := pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[node.Port]++
+	}
+	return picked
+}
+
+func TestSelectNode(t *testing.T) {
+	inLane := func(node *discovery.Node, lane string) *discovery.Node {
+		node.Labels = map[string]string{discovery.LabelLane: lane}
+		return node
+	}
+	asSlave := func(node *discovery.Node) *discovery.Node {
+		node.SlaveFlag = 1
+		return node
+	}
+	ofVersion := func(node *discovery.Node, version string) *discovery.Node {
+		node.Version = version
+		return node
+	}
+	toV2 := []*discovery.TrafficSplit{{Version: "v2", Percent: 100}}
+
+	tests := []struct {
+		name   string
+		nodes  []*discovery.Node
+		splits []*discovery.TrafficSplit
+		lane   string
+		role   util.Role
+		expect []int
+	}{
+		{
+			name: "split in lane",
+			nodes: []*discovery.Node{
+				ofVersion(discovery.NewNode("127.2.1.1", 1), "v1"),
+				ofVersion(discovery.NewNode("127.2.1.1", 2), "v2"),
+				inLane(ofVersion(discovery.NewNode("127.2.1.1", 3), "v1"), "blue"),
+				inLane(ofVersion(discovery.NewNode("127.2.1.1", 4), "v2"), "blue"),
+			},
+			splits: toV2,
+			lane:   "blue",
+			expect: []int{4},
+		},
+		{
+			name: "split version only in another lane",
+			nodes: []*discovery.Node{
+				ofVersion(discovery.NewNode("127.2.1.1", 1), "v1"),
+				inLane(ofVersion(discovery.NewNode("127.2.1.1", 2), "v2"), "blue"),
+			},
+			splits: toV2,
+			expect: []int{1},
+		},
+		{
+			name: "lane wins over split",
+			nodes: []*discovery.Node{
+				ofVersion(discovery.NewNode("127.2.1.1", 1), "v2"),
+				inLane(ofVersion(discovery.NewNode("127.2.1.1", 2), "v1"), "blue"),
+			},
+			splits: toV2,
+			lane:   "blue",
+			expect: []int{2},
+		},
+		{
+			name: "split version only of another role",
+			nodes: []*discovery.Node{
+				ofVersion(discovery.NewNode("127.2.1.1", 1), "v1"),
+				asSlave(ofVersion(discovery.NewNode("127.2.1.1", 2), "v2")),
+			},
+			splits: toV2,
+			role:   util.RoleMasterOnly,
+			expect: []int{1},
+		},
+		{
+			name: "split without lane",
+			nodes: []*discovery.Node{
+				ofVersion(discovery.NewNode("127.2.1.1", 1), "v1"),
+				ofVersion(discovery.NewNode("127.2.1.1", 2), "v2"),
+				inLane(ofVersion(discovery.NewNode("127.2.1.1", 3), "v2"), "blue"),
+			},
+			splits: toV2,
+			expect: []int{2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := util.WithRole(util.WithLane(context.Background(), test.lane), test.role)
+
+			picked := pickPorts(t, 100, func() (*discovery.Node, error) {
+				return util.SelectNode(ctx, test.nodes, test.splits)
+			})
+			if len(picked) != len(test.expect) {
+				t.Fatalf("expect ports %v picked, got %v", test.expect, picked)
+			}
+			for _, port := range test.expect {
+				if picked[port] == 0 {
+					t.Fatalf("expect ports %v picked, got %v", test.expect, picked)
+				}
+			}
+		})
+	}
+}
+
+func TestPickIndexByWeight(t *testing.T) {
+	withPriority := func(port, priority int) *discovery.Node {
+		node := discovery.NewNode("127.2.1.1", port)
+		node.Priority = priority
+		return node
+	}
+
+	tests := []struct {
+		name  string
+		nodes []*discovery.Node
+		// expect is the share in percent of picks expected by each port
+		expect map[int]float64
+	}{
+		{
+			name:   "weighted",
+			nodes:  []*discovery.Node{withPriority(1, 100), withPriority(2, 300)},
+			expect: map[int]float64{1: 25, 2: 75},
+		},
+		{
+			name:   "default weight",
+			nodes:  []*discovery.Node{withPriority(1, 0), withPriority(2, discovery.DefaultNodeWeight)},
+			expect: map[int]float64{1: 50, 2: 50},
+		},
+		{
+			name:   "all zero",
+			nodes:  []*discovery.Node{withPriority(1, 0), withPriority(2, 0), withPriority(3, -1), withPriority(4, 0)},
+			expect: map[int]float64{1: 25, 2: 25, 3: 25, 4: 25},
+		},
+		{
+			name:   "only one",
+			nodes:  []*discovery.Node{withPriority(1, 1)},
+			expect: map[int]float64{1: 100},
+		},
+	}
+
+	const n = 10000
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			picked := pickPorts(t, n, func() (*discovery.Node, error) {
+				idx := util.PickIndexByWeight(test.nodes)
+				if idx < 0 {
+					return nil, fmt.Errorf("no node picked from %d nodes", len(test.nodes))
+				}
+				return test.nodes[idx], nil
+			})
+			if len(picked) != len(test.expect) {
+				t.Fatalf("expect shares %v, got picks %v", test.expect, picked)
+			}
+			for port, share := range test.expect {
+				if got := float64(picked[port]) * 100 / n; math.Abs(got-share) > 3 {
+					t.Fatalf("expect share %.0f%% of port %d, got %.2f%%", share, port, got)
+				}
+			}
+		})
+	}
+
+	if idx := util.PickIndexByWeight(nil); idx != -1 {
+		t.Fatalf("expect -1 picked from no node, got %d", idx)
+	}
+}
+
+func TestNodeWeight(t *testing.T) {
+	tests := []struct {
+		priority, expect int
+	}{
+		{0, discovery.DefaultNodeWeight},
+		{-1, discovery.DefaultNodeWeight},
+		{1, 1},
+		{99, 99},
+		{discovery.DefaultNodeWeight, discovery.DefaultNodeWeight},
+		{300, 300},
+	}
+
+	for _, test := range tests {
+		node := discovery.NewNode("127.2.1.1", 1)
+		node.Priority = test.priority
+		if weight := node.Weight(); weight != test.expect {
+			t.Fatalf("expect weight %d of priority %d, got %d", test.expect, test.priority, weight)
+		}
+	}
+
+	// unset outweighs low priorities
+	unset, low := discovery.NewNode("127.2.1.1", 1), discovery.NewNode("127.2.1.1", 2)
+	low.Priority = 99
+	if unset.Weight() <= low.Weight() {
+		t.Fatalf("expect node without priority outweighs priority 99, got %d and %d", unset.Weight(), low.Weight())
+	}
+}
+
+// ports returns ports of nodes in order.
+func ports(nodes []*discovery.Node) []int {
+	var ports []int
+	for _, node := range nodes {
+		ports = append(ports, node.Port)
+	}
+	return ports
+}
+
+func TestFilterByRole(t *testing.T) {
+	master := discovery.NewNode("127.2.1.1", 1)
+	slave := discovery.NewNode("127.2.1.1", 2)
+	slave.SlaveFlag = 1
+	both := []*discovery.Node{master, slave}
+
+	tests := []struct {
+		name   string
+		nodes  []*discovery.Node
+		role   util.Role
+		expect []int
+	}{
+		{name: "any", nodes: both, role: util.RoleAny, expect: []int{1, 2}},
+		{name: "master only", nodes: both, role: util.RoleMasterOnly, expect: []int{1}},
+		{name: "slave only", nodes: both, role: util.RoleSlaveOnly, expect: []int{2}},
+		{name: "prefer master", nodes: both, role: util.RolePreferMaster, expect: []int{1}},
+		{name: "prefer slave", nodes: both, role: util.RolePreferSlave, expect: []int{2}},
+		{name: "master only without master", nodes: []*discovery.Node{slave}, role: util.RoleMasterOnly},
+		{name: "slave only without slave", nodes: []*discovery.Node{master}, role: util.RoleSlaveOnly},
+		{name: "prefer master fails over", nodes: []*discovery.Node{slave}, role: util.RolePreferMaster, expect: []int{2}},
+		{name: "prefer slave fails over", nodes: []*discovery.Node{master}, role: util.RolePreferSlave, expect: []int{1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ports(util.FilterByRole(test.nodes, test.role)); !reflect.DeepEqual(got, test.expect) {
+				t.Fatalf("expect ports %v, got %v", test.expect, got)
+			}
+		})
+	}
+}
+
+func TestFilterByZone(t *testing.T) {
+	inZone := func(port int, zone string) *discovery.Node {
+		node := discovery.NewNode("127.2.1.1", port)
+		node.Zone = zone
+		return node
+	}
+	z1Nodes := []*discovery.Node{inZone(1, "z1"), inZone(2, "z1"), inZone(3, "z1"), inZone(4, "z1")}
+	z2Nodes := []*discovery.Node{inZone(5, "z2"), inZone(6, "z2")}
+	allNodes := append(append([]*discovery.Node{}, z1Nodes...), z2Nodes...)
+	// half of nodes in z1 are unhealthy
+	halfHealthyNodes := append(append([]*discovery.Node{}, z1Nodes[:2]...), z2Nodes...)
+
+	tests := []struct {
+		name           string
+		healthyNodes   []*discovery.Node
+		zone           string
+		spillThreshold float64
+		expect         []int
+	}{
+		{name: "no zone", healthyNodes: allNodes, spillThreshold: 0.7, expect: []int{1, 2, 3, 4, 5, 6}},
+		{name: "all healthy", healthyNodes: allNodes, zone: "z1", spillThreshold: 0.7, expect: []int{1, 2, 3, 4}},
+		{name: "above threshold", healthyNodes: halfHealthyNodes, zone: "z1", spillThreshold: 0.4, expect: []int{1, 2}},
+		{name: "at threshold", healthyNodes: halfHealthyNodes, zone: "z1", spillThreshold: 0.5, expect: []int{1, 2}},
+		{name: "below threshold spills", healthyNodes: halfHealthyNodes, zone: "z1", spillThreshold: 0.7, expect: []int{1, 2, 5, 6}},
+		{name: "zero threshold never spills", healthyNodes: halfHealthyNodes[1:], zone: "z1", expect: []int{2}},
+		{name: "empty local zone", healthyNodes: z2Nodes, zone: "z1", spillThreshold: 0.7, expect: []int{5, 6}},
+		{name: "unknown zone", healthyNodes: allNodes, zone: "z3", spillThreshold: 0.7, expect: []int{1, 2, 3, 4, 5, 6}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ports(util.FilterByZone(test.healthyNodes, allNodes, test.zone, test.spillThreshold))
+			if !reflect.DeepEqual(got, test.expect) {
+				t.Fatalf("expect ports %v, got %v", test.expect, got)
+			}
+		})
+	}
+}
+
+func TestFilterBySplits(t *testing.T) {
+	ofVersion := func(port int, version string) *discovery.Node {
+		node := discovery.NewNode("127.2.1.1", port)
+		node.Version = version
+		return node
+	}
+	nodes := []*discovery.Node{ofVersion(1, "v1"), ofVersion(2, "v1"), ofVersion(3, "v2")}
+
+	tests := []struct {
+		name   string
+		splits []*discovery.TrafficSplit
+		// expect is the share in percent of calls expected by ports filtered
+		expect map[string]float64
+	}{
+		{
+			name:   "no split",
+			expect: map[string]float64{"[1 2 3]": 100},
+		},
+		{
+			name:   "0%",
+			splits: []*discovery.TrafficSplit{{Version: "v2", Percent: 0}},
+			expect: map[string]float64{"[1 2]": 100},
+		},
+		{
+			name:   "100%",
+			splits: []*discovery.TrafficSplit{{Version: "v2", Percent: 100}},
+			expect: map[string]float64{"[3]": 100},
+		},
+		{
+			name:   "partial",
+			splits: []*discovery.TrafficSplit{{Version: "v2", Percent: 30}},
+			expect: map[string]float64{"[1 2]": 70, "[3]": 30},
+		},
+		{
+			name:   "version without nodes",
+			splits: []*discovery.TrafficSplit{{Version: "v3", Percent: 100}},
+			expect: map[string]float64{"[1 2 3]": 100},
+		},
+		{
+			name:   "partial to version without nodes",
+			splits: []*discovery.TrafficSplit{{Version: "v2", Percent: 30}, {Version: "v3", Percent: 40}},
+			expect: map[string]float64{"[3]": 30, "[1 2 3]": 40, "[1 2]": 30},
+		},
+	}
+
+	const n = 10000
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filtered := map[string]int{}
+			for i := 0; i < n; i++ {
+				filtered[fmt.Sprint(ports(util.FilterBySplits(nodes, test.splits)))]++
+			}
+			if len(filtered) != len(test.expect) {
+				t.Fatalf("expect shares %v, got filtered %v", test.expect, filtered)
+			}
+			for key, share := range test.expect {
+				if got := float64(filtered[key]) * 100 / n; math.Abs(got-share) > 3 {
+					t.Fatalf("expect share %.0f%% of ports %s, got %.2f%%", share, key, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/filecachedproxy"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+)
+
+func recvWatchEvt(t *testing.T, evtCh <-chan *discovery.WatchEvt) *discovery.WatchEvt {
+	t.Helper()
+	select {
+	case evt, ok := <-evtCh:
+		if !ok {
+			t.Fatal("watch channel closed")
+		}
+		return evt
+	case <-time.After(time.Second):
+		t.Fatal("wait watch event timeout")
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	discover := memory.NewDiscovery()
+
+	ctx := context.Background()
+
+	if err := discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the legacy callback must not steal events from subscribers
+	discover.OnSrvUpdated(func(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {})
+
+	allCtx, cancelAll := context.WithCancel(ctx)
+	allEvtCh, err := discover.Watch(allCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oneEvtCh, err := discover.Watch(ctx, "logv4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evt := recvWatchEvt(t, allEvtCh)
+	if evt.Evt != discovery.EvtUpdated || evt.Srv.SrvName != "logv3" || len(evt.Srv.Nodes) != 1 {
+		t.Fatalf("unexpected snapshot %+v", evt)
+	}
+
+	if err = discover.Register(ctx, "logv4", discovery.NewNode("127.2.1.1", 12015)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, evtCh := range []<-chan *discovery.WatchEvt{allEvtCh, oneEvtCh} {
+		evt = recvWatchEvt(t, evtCh)
+		if evt.Evt != discovery.EvtUpdated || evt.Srv.SrvName != "logv4" {
+			t.Fatalf("unexpected event %+v", evt)
+		}
+	}
+
+	cancelAll()
+	select {
+	case _, ok := <-allEvtCh:
+		if ok {
+			t.Fatal("expect channel closed after canceled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after canceled")
+	}
+
+	if err = discover.UnregisterAll(ctx, "logv3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = discover.UnregisterAll(ctx, "logv4"); err != nil {
+		t.Fatal(err)
+	}
+
+	evt = recvWatchEvt(t, oneEvtCh)
+	if evt.Evt != discovery.EvtDeleted || evt.Srv.SrvName != "logv4" {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+}
+
+// checkWatchSnapshot checks that subscribing all services notifies nobody else, and that subscribing a service
+// not registered yet delivers its registration.
+func checkWatchSnapshot(t *testing.T, discover discovery.Discovery) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := discover.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+
+	var notified atomic.Int32
+	discover.OnSrvUpdated(func(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {
+		notified.Add(1)
+	})
+
+	oneEvtCh, err := discover.Watch(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt := recvWatchEvt(t, oneEvtCh); evt.Srv.SrvName != "logv3" {
+		t.Fatalf("unexpected snapshot %+v", evt)
+	}
+
+	allEvtCh, err := discover.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt := recvWatchEvt(t, allEvtCh); evt.Srv.SrvName != "logv3" {
+		t.Fatalf("unexpected snapshot %+v", evt)
+	}
+
+	select {
+	case evt := <-oneEvtCh:
+		t.Fatalf("snapshot of another subscriber delivered %+v", evt)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := notified.Load(); n != 0 {
+		t.Fatalf("snapshot notified OnSrvUpdated %d times", n)
+	}
+
+	newEvtCh, err := discover.Watch(ctx, "logv5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = discover.Register(ctx, "logv5", discovery.NewNode("127.2.1.1", 12015)); err != nil {
+		t.Fatal(err)
+	}
+
+	evt := recvWatchEvt(t, newEvtCh)
+	if evt.Evt != discovery.EvtUpdated || evt.Srv.SrvName != "logv5" || len(evt.Srv.Nodes) != 1 {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+}
+
+func TestMemoryWatchSnapshot(t *testing.T) {
+	checkWatchSnapshot(t, memory.NewDiscovery())
+}
+
+// checkDiff checks diffs of events made by changes, which add a node, kill a node and remove the dead one from
+// the service having one node in order.
+func checkDiff(t *testing.T, discover discovery.Discovery, changes ...func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evtCh, err := discover.Watch(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evt := recvWatchEvt(t, evtCh)
+	if len(evt.Diff.Added) != 1 {
+		t.Fatalf("expect all nodes added by the first event, got %+v", evt.Diff)
+	}
+
+	expects := []struct {
+		added, removed, stateChanged int
+	}{
+		{1, 0, 0},
+		{0, 0, 1},
+		{0, 1, 0},
+	}
+	revision := evt.Revision
+	for i, change := range changes {
+		change()
+
+		evt = recvWatchEvt(t, evtCh)
+		expect := expects[i]
+		if len(evt.Diff.Added) != expect.added || len(evt.Diff.Removed) != expect.removed || len(evt.Diff.StateChanged) != expect.stateChanged {
+			t.Fatalf("unexpected diff %+v of nodes %+v", evt.Diff, evt.Srv.Nodes)
+		}
+		if evt.Revision <= revision {
+			t.Fatalf("revision %d not increased from %d", evt.Revision, revision)
+		}
+		revision = evt.Revision
+	}
+}
+
+// registerChanges returns changes for checkDiff made by registering to discover.
+func registerChanges(t *testing.T, discover discovery.Discovery) []func() {
+	ctx := context.Background()
+	node1, node2 := discovery.NewNode("127.2.1.1", 12014), discovery.NewNode("127.2.1.1", 12015)
+
+	if err := discover.Register(ctx, "logv3", node1); err != nil {
+		t.Fatal(err)
+	}
+
+	return []func(){
+		func() {
+			if err := discover.Register(ctx, "logv3", node2); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func() {
+			if err := discover.Unregister(ctx, "logv3", node1, false); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func() {
+			if err := discover.Unregister(ctx, "logv3", node1, true); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+}
+
+func TestMemoryWatchDiff(t *testing.T) {
+	discover := memory.NewDiscovery()
+
+	var revision int64
+	discover.OnSrvUpdated(func(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {
+		if watchEvt, ok := discovery.WatchEvtFromCtx(ctx); ok {
+			revision = watchEvt.Revision
+		}
+	})
+
+	checkDiff(t, discover, registerChanges(t, discover)...)
+
+	if revision == 0 {
+		t.Fatal("expect revision of change attached to ctx")
+	}
+}
+
+func TestFileCachedProxyWatchDiff(t *testing.T) {
+	dir := t.TempDir()
+
+	var contract discovery.FileCachedProxyContract
+	writeNodes := func(nodes ...*discovery.Node) {
+		srvJson, err := json.Marshal(&discovery.Service{
+			SrvName: "logv3",
+			Nodes:   nodes,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(contract.GetCacheFilePathBySrv(dir, "logv3"), srvJson, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node1 := &discovery.Node{Host: "127.2.1.1", Port: 12014, Status: discovery.NodeStateAlive}
+	node2 := &discovery.Node{Host: "127.2.1.1", Port: 12015, Status: discovery.NodeStateAlive}
+	deadNode1 := &discovery.Node{Host: "127.2.1.1", Port: 12014, Status: discovery.NodeStateDead}
+	writeNodes(node1)
+
+	discover := filecachedproxy.NewDiscovery(dir, memory.NewDiscovery())
+	defer discover.Close(context.Background())
+
+	checkDiff(t, discover,
+		func() { writeNodes(node1, node2) },
+		func() { writeNodes(deadNode1, node2) },
+		func() { writeNodes(node2) },
+	)
+}
+
+func TestFileCachedProxyDiscoverFromConn(t *testing.T) {
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := memory.NewDiscovery()
+	if err := conn.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+
+	discover := filecachedproxy.NewDiscovery(dir, conn)
+	defer discover.Close(ctx)
+
+	var notified atomic.Int32
+	discover.OnSrvUpdated(func(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {
+		notified.Add(1)
+	})
+
+	// not synced by the proxy yet
+	evtCh, err := discover.Watch(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt := recvWatchEvt(t, evtCh); len(evt.Srv.Nodes) != 1 {
+		t.Fatalf("unexpected snapshot %+v", evt)
+	}
+
+	// cached once loaded, nothing changed
+	for i := 0; i < 2; i++ {
+		if srv, err := discover.Discover(ctx, "logv3"); err != nil || len(srv.Nodes) != 1 {
+			t.Fatalf("unexpected service %+v, err:%v", srv, err)
+		}
+	}
+	select {
+	case evt := <-evtCh:
+		t.Fatalf("unexpected event %+v", evt)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := notified.Load(); n != 0 {
+		t.Fatalf("unchanged service notified OnSrvUpdated %d times", n)
+	}
+
+	// replaced by the cache file once synced
+	var contract discovery.FileCachedProxyContract
+	if err = contract.WriteCacheFile(dir, &discovery.Service{
+		SrvName: "logv3",
+		Nodes:   []*discovery.Node{discovery.NewNode("127.2.1.1", 12014), discovery.NewNode("127.2.1.1", 12015)},
+	}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if evt := recvWatchEvt(t, evtCh); len(evt.Srv.Nodes) != 2 || len(evt.Diff.Added) != 1 {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"context"
+
+	"github.com/995933447/microgosuit/discovery"
+)
+
+type laneCtxKey struct{}
+
+// WithLane makes calls with the returned context route to nodes in lane.
+func WithLane(ctx context.Context, lane string) context.Context {
+	return context.WithValue(ctx, laneCtxKey{}, lane)
+}
+
+func LaneFromCtx(ctx context.Context) string {
+	lane, _ := ctx.Value(laneCtxKey{}).(string)
+	return lane
+}
+
+// FilterByLane returns nodes in lane, or baseline nodes which are in no lane if lane is empty or there is none
+// in lane. Nodes in a lane never serve calls out of it.
+func FilterByLane(nodes []*discovery.Node, lane string) []*discovery.Node {
+	var (
+		laneNodes     []*discovery.Node
+		baselineNodes []*discovery.Node
+	)
+	for _, node := range nodes {
+		nodeLane := node.Label(discovery.LabelLane)
+		if nodeLane == "" {
+			baselineNodes = append(baselineNodes, node)
+			continue
+		}
+		if lane != "" && nodeLane == lane {
+			laneNodes = append(laneNodes, node)
+		}
+	}
+
+	if len(laneNodes) > 0 {
+		return laneNodes
+	}
+
+	return baselineNodes
+}
@@ -1,19 +1,31 @@
 package util
 
 import (
-	"github.com/995933447/runtimeutil"
+	"sync"
 )
 
+// SpecSrvMuFactory makes a mutex per service, so changes of a service are serialized without blocking others.
+// Mutexes are kept in a plain map guarded by its own lock, it's safe for concurrent use.
 type SpecSrvMuFactory struct {
-	*runtimeutil.MulElemMuFactory
+	mu       sync.Mutex
+	srvMuMap map[string]*sync.Mutex
 }
 
 func NewSpecSrvMuFactory() *SpecSrvMuFactory {
 	return &SpecSrvMuFactory{
-		MulElemMuFactory: runtimeutil.NewMulElemMuFactory(),
+		srvMuMap: map[string]*sync.Mutex{},
 	}
 }
 
-func (m *SpecSrvMuFactory) MakeOrGetOpOneSrvMu(srvName string) *runtimeutil.WithUsageMu {
-	return m.MakeOrGetSpecElemMu(srvName)
+func (m *SpecSrvMuFactory) MakeOrGetOpOneSrvMu(srvName string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mu, ok := m.srvMuMap[srvName]
+	if !ok {
+		mu = &sync.Mutex{}
+		m.srvMuMap[srvName] = mu
+	}
+
+	return mu
 }
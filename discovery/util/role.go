@@ -0,0 +1,56 @@
+package util
+
+import (
+	"context"
+
+	"github.com/995933447/microgosuit/discovery"
+)
+
+// Role decides which of master and slave nodes are routed to, nodes are masters unless their SlaveFlag set.
+type Role int
+
+const (
+	RoleAny Role = iota
+	RolePreferMaster
+	RolePreferSlave
+	RoleMasterOnly
+	RoleSlaveOnly
+)
+
+type roleCtxKey struct{}
+
+// WithRole makes calls with the returned context route by role.
+func WithRole(ctx context.Context, role Role) context.Context {
+	return context.WithValue(ctx, roleCtxKey{}, role)
+}
+
+func RoleFromCtx(ctx context.Context) (Role, bool) {
+	role, ok := ctx.Value(roleCtxKey{}).(Role)
+	return role, ok
+}
+
+// FilterByRole returns nodes of role. Preferring roles fail over to nodes of the other role if there is none
+// of the preferred one.
+func FilterByRole(nodes []*discovery.Node, role Role) []*discovery.Node {
+	var wantSlave bool
+	switch role {
+	case RolePreferMaster, RoleMasterOnly:
+	case RolePreferSlave, RoleSlaveOnly:
+		wantSlave = true
+	default:
+		return nodes
+	}
+
+	var filtered []*discovery.Node
+	for _, node := range nodes {
+		if node.IsSlave() == wantSlave {
+			filtered = append(filtered, node)
+		}
+	}
+
+	if len(filtered) == 0 && (role == RolePreferMaster || role == RolePreferSlave) {
+		return nodes
+	}
+
+	return filtered
+}
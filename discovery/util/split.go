@@ -0,0 +1,50 @@
+package util
+
+import (
+	"math/rand"
+
+	"github.com/995933447/microgosuit/discovery"
+)
+
+// FilterBySplits picks the version a call goes to by splits randomly and returns nodes of it. Calls not split
+// go to nodes of versions not split. Calls go to all nodes if there is none of the version picked.
+func FilterBySplits(nodes []*discovery.Node, splits []*discovery.TrafficSplit) []*discovery.Node {
+	if len(splits) == 0 {
+		return nodes
+	}
+
+	var (
+		randN           = rand.Float64() * 100
+		pickedVersion   string
+		isSplitVersions = map[string]bool{}
+	)
+	for _, split := range splits {
+		isSplitVersions[split.Version] = true
+		if pickedVersion != "" {
+			continue
+		}
+		randN -= split.Percent
+		if randN < 0 {
+			pickedVersion = split.Version
+		}
+	}
+
+	var filtered []*discovery.Node
+	for _, node := range nodes {
+		if pickedVersion != "" {
+			if node.Version == pickedVersion {
+				filtered = append(filtered, node)
+			}
+			continue
+		}
+		if !isSplitVersions[node.Version] {
+			filtered = append(filtered, node)
+		}
+	}
+
+	if len(filtered) == 0 {
+		return nodes
+	}
+
+	return filtered
+}
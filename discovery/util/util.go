@@ -2,8 +2,9 @@ package util
 
 import (
 	"context"
-	"github.com/995933447/microgosuit/discovery"
 	"math/rand"
+
+	"github.com/995933447/microgosuit/discovery"
 )
 
 func Route(ctx context.Context, discover discovery.Discovery, srvName string) (*discovery.Node, error) {
@@ -16,15 +17,54 @@ func Route(ctx context.Context, discover discovery.Discovery, srvName string) (*
 		return nil, discovery.ErrNodeNotFound
 	}
 
-	nodeNum := len(srv.Nodes)
-	randN := rand.Int()
-	for i := 0; i < nodeNum; i++ {
-		node := srv.Nodes[randN%nodeNum]
+	var availableNodes []*discovery.Node
+	for _, node := range srv.Nodes {
 		if node.Available() {
-			return node, nil
+			availableNodes = append(availableNodes, node)
+		}
+	}
+
+	return SelectNode(ctx, availableNodes, srv.TrafficSplits)
+}
+
+// SelectNode picks one of healthy nodes following routing policies carried by ctx, splits and their weights.
+// Lane and role are followed before splits, so a split never leaves no node the call is allowed to go to.
+func SelectNode(ctx context.Context, nodes []*discovery.Node, splits []*discovery.TrafficSplit) (*discovery.Node, error) {
+	nodes = FilterByLane(nodes, LaneFromCtx(ctx))
+
+	if role, ok := RoleFromCtx(ctx); ok {
+		nodes = FilterByRole(nodes, role)
+	}
+
+	nodes = FilterBySplits(nodes, splits)
+
+	idx := PickIndexByWeight(nodes)
+	if idx < 0 {
+		return nil, discovery.ErrNodeNotFound
+	}
+
+	return nodes[idx], nil
+}
+
+// PickIndexByWeight picks one of nodes randomly in proportion to their weights and returns its index,
+// -1 if nodes is empty.
+func PickIndexByWeight(nodes []*discovery.Node) int {
+	var totalWeight int
+	for _, node := range nodes {
+		totalWeight += node.Weight()
+	}
+
+	if totalWeight <= 0 {
+		return -1
+	}
+
+	randN := rand.Intn(totalWeight)
+	for i, node := range nodes {
+		randN -= node.Weight()
+		if randN < 0 {
+			return i
 		}
-		randN++
 	}
 
-	return nil, discovery.ErrNodeNotFound
+	return -1
 }
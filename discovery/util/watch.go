@@ -0,0 +1,209 @@
+package util
+
+import (
+	"context"
+	"sync"
+
+	"github.com/995933447/microgosuit/discovery"
+)
+
+// Watchers fans out changes of services to every subscriber created by Watch, each subscriber has its own
+// queue so a slow one never blocks the others or the publisher.
+type Watchers struct {
+	mu       sync.RWMutex
+	watchers map[*watcher]struct{}
+}
+
+func NewWatchers() *Watchers {
+	return &Watchers{
+		watchers: map[*watcher]struct{}{},
+	}
+}
+
+type watcher struct {
+	srvNames map[string]struct{}
+	mu       sync.Mutex
+	queue    []*discovery.WatchEvt
+	notified map[string]struct{}
+	pushed   map[string]struct{}
+	notifyCh chan struct{}
+	closeCh  chan struct{}
+	once     sync.Once
+	evtCh    chan *discovery.WatchEvt
+}
+
+func (w *watcher) interested(srvName string) bool {
+	if len(w.srvNames) == 0 {
+		return true
+	}
+	_, ok := w.srvNames[srvName]
+	return ok
+}
+
+func (w *watcher) push(evt *discovery.WatchEvt, isSnapshot bool) {
+	w.mu.Lock()
+	if isSnapshot {
+		// a change notified after subscribing is at least as new as the snapshot
+		if _, ok := w.notified[evt.Srv.SrvName]; ok {
+			w.mu.Unlock()
+			return
+		}
+	} else {
+		w.notified[evt.Srv.SrvName] = struct{}{}
+		// the subscriber knows nothing of the service before its first event
+		if _, ok := w.pushed[evt.Srv.SrvName]; !ok {
+			rebased := *evt
+			rebased.Diff = discovery.DiffSrv(nil, evt.Srv)
+			evt = &rebased
+		}
+	}
+	w.pushed[evt.Srv.SrvName] = struct{}{}
+	w.queue = append(w.queue, evt)
+	w.mu.Unlock()
+
+	select {
+	case w.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) close() {
+	w.once.Do(func() {
+		close(w.closeCh)
+	})
+}
+
+func (w *watcher) run(ctx context.Context) {
+	defer close(w.evtCh)
+
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+
+		for _, evt := range queue {
+			select {
+			case w.evtCh <- evt:
+			case <-ctx.Done():
+				return
+			case <-w.closeCh:
+				return
+			}
+		}
+
+		select {
+		case <-w.notifyCh:
+		case <-ctx.Done():
+			return
+		case <-w.closeCh:
+			return
+		}
+	}
+}
+
+// Watch subscribes changes of srvNames, or all services if srvNames is empty. The snapshots returned by
+// loadSnapshot are delivered first unless the services changed meanwhile. The channel is closed once ctx is done
+// or CloseAll is called.
+func (ws *Watchers) Watch(ctx context.Context, srvNames []string, loadSnapshot func(ctx context.Context) ([]*discovery.WatchEvt, error)) (<-chan *discovery.WatchEvt, error) {
+	w := &watcher{
+		srvNames: map[string]struct{}{},
+		notified: map[string]struct{}{},
+		pushed:   map[string]struct{}{},
+		notifyCh: make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+		evtCh:    make(chan *discovery.WatchEvt),
+	}
+	for _, srvName := range srvNames {
+		w.srvNames[srvName] = struct{}{}
+	}
+
+	ws.mu.Lock()
+	ws.watchers[w] = struct{}{}
+	ws.mu.Unlock()
+
+	snapshots, err := loadSnapshot(ctx)
+	if err != nil {
+		ws.remove(w)
+		return nil, err
+	}
+
+	for _, evt := range snapshots {
+		if !w.interested(evt.Srv.SrvName) {
+			continue
+		}
+		w.push(evt, true)
+	}
+
+	go func() {
+		w.run(ctx)
+		ws.remove(w)
+	}()
+
+	return w.evtCh, nil
+}
+
+func (ws *Watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	delete(ws.watchers, w)
+	ws.mu.Unlock()
+	w.close()
+}
+
+// Notify publishes a change of srv without diff and revision to subscribers interested in it, it never blocks.
+func (ws *Watchers) Notify(evt discovery.Evt, srv *discovery.Service) {
+	ws.Publish(&discovery.WatchEvt{
+		Evt: evt,
+		Srv: srv,
+	})
+}
+
+// Publish publishes evt to subscribers interested in it, it never blocks.
+func (ws *Watchers) Publish(evt *discovery.WatchEvt) {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	for w := range ws.watchers {
+		if !w.interested(evt.Srv.SrvName) {
+			continue
+		}
+		w.push(evt, false)
+	}
+}
+
+// CloseAll closes channels of all subscribers.
+func (ws *Watchers) CloseAll() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.watchers {
+		w.close()
+		delete(ws.watchers, w)
+	}
+}
+
+// NewSnapshot makes the snapshot of srv loaded at revision, all of its nodes are added.
+func NewSnapshot(srv *discovery.Service, revision int64) *discovery.WatchEvt {
+	return discovery.NewWatchEvt(discovery.EvtUpdated, nil, srv, revision)
+}
+
+// LoadSnapshot loads snapshots of srvNames one by one by load, services not found are skipped. All services are
+// loaded by loadAll if srvNames is empty. Neither of them may notify anyone, since the snapshot is only for the
+// new subscriber.
+func LoadSnapshot(ctx context.Context, srvNames []string, loadAll func(ctx context.Context) ([]*discovery.WatchEvt, error), load func(ctx context.Context, srvName string) (*discovery.WatchEvt, error)) ([]*discovery.WatchEvt, error) {
+	if len(srvNames) == 0 {
+		return loadAll(ctx)
+	}
+
+	var snapshots []*discovery.WatchEvt
+	for _, srvName := range srvNames {
+		evt, err := load(ctx, srvName)
+		if err != nil {
+			if err == discovery.ErrSrvNotFound {
+				continue
+			}
+			return nil, err
+		}
+		snapshots = append(snapshots, evt)
+	}
+
+	return snapshots, nil
+}
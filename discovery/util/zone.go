@@ -0,0 +1,40 @@
+package util
+
+import "github.com/995933447/microgosuit/discovery"
+
+// FilterByZone returns healthyNodes in zone, or all healthyNodes if there is none of them in zone or weight of
+// them in zone falls below spillThreshold of the weight of allNodes in zone. allNodes are all nodes known
+// including unhealthy ones. healthyNodes are returned as is if zone is empty.
+func FilterByZone(healthyNodes, allNodes []*discovery.Node, zone string, spillThreshold float64) []*discovery.Node {
+	if zone == "" {
+		return healthyNodes
+	}
+
+	var (
+		localNodes         []*discovery.Node
+		localHealthyWeight int
+		localTotalWeight   int
+	)
+	for _, node := range healthyNodes {
+		if node.Zone == zone {
+			localNodes = append(localNodes, node)
+			localHealthyWeight += node.Weight()
+		}
+	}
+
+	if len(localNodes) == 0 {
+		return healthyNodes
+	}
+
+	for _, node := range allNodes {
+		if node.Zone == zone {
+			localTotalWeight += node.Weight()
+		}
+	}
+
+	if localTotalWeight > 0 && float64(localHealthyWeight) < spillThreshold*float64(localTotalWeight) {
+		return healthyNodes
+	}
+
+	return localNodes
+}
@@ -0,0 +1,291 @@
+package discoveryproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/log"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultApiWait       = 30 * time.Second
+	maxApiWait           = 5 * time.Minute
+	sseKeepAliveInterval = 15 * time.Second
+	apiShutdownTimeout   = 5 * time.Second
+)
+
+type listSrvsResp struct {
+	Index    int64                `json:"index"`
+	Services []*discovery.Service `json:"services"`
+}
+
+type discoverSrvResp struct {
+	Index int64              `json:"index"`
+	Srv   *discovery.Service `json:"srv"`
+}
+
+type apiErrResp struct {
+	Index int64  `json:"index,omitempty"`
+	Error string `json:"error"`
+}
+
+type apiWatchEvt struct {
+	Index int64              `json:"index"`
+	Evt   string             `json:"evt"` // updated or deleted
+	Srv   *discovery.Service `json:"srv"`
+}
+
+// Handler returns the query API on the in-memory view of the proxy, for clients which can't read cache files by
+// filecachedproxy:
+//
+//	GET /v1/services           lists all services
+//	GET /v1/services/{name}    discovers a service
+//	GET /v1/watch?srv={name}   streams changes of services as server-sent events, all services if no srv given
+//
+// The first two are long polling if query parameter index is given, they block until changed since the index or
+// for query parameter wait at most, 30s by default.
+func (p *Proxy) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/services", p.handleListSrvs)
+	mux.HandleFunc("GET /v1/services/{name}", p.handleDiscoverSrv)
+	mux.HandleFunc("GET /v1/watch", p.handleWatch)
+	return mux
+}
+
+// parseLongPolling returns index and wait of long polling, index is -1 if r doesn't wait for changes.
+func parseLongPolling(r *http.Request) (int64, time.Duration, error) {
+	query := r.URL.Query()
+
+	index := int64(-1)
+	if val := query.Get("index"); val != "" {
+		var err error
+		if index, err = strconv.ParseInt(val, 10, 64); err != nil || index < 0 {
+			return 0, 0, fmt.Errorf("invalid index %q", val)
+		}
+	}
+
+	wait := defaultApiWait
+	if val := query.Get("wait"); val != "" {
+		var err error
+		if wait, err = time.ParseDuration(val); err != nil || wait < 0 {
+			return 0, 0, fmt.Errorf("invalid wait %q", val)
+		}
+		if wait > maxApiWait {
+			wait = maxApiWait
+		}
+	}
+
+	return index, wait, nil
+}
+
+func writeApiResp(w http.ResponseWriter, statusCode int, index int64, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Discovery-Index", strconv.FormatInt(index, 10))
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Logger.Error(nil, err)
+	}
+}
+
+func (p *Proxy) handleListSrvs(w http.ResponseWriter, r *http.Request) {
+	index, wait, err := parseLongPolling(r)
+	if err != nil {
+		writeApiResp(w, http.StatusBadRequest, 0, &apiErrResp{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	p.view.wait(ctx, index)
+
+	services, viewIndex := p.view.list()
+	writeApiResp(w, http.StatusOK, viewIndex, &listSrvsResp{
+		Index:    viewIndex,
+		Services: services,
+	})
+}
+
+func (p *Proxy) handleDiscoverSrv(w http.ResponseWriter, r *http.Request) {
+	index, wait, err := parseLongPolling(r)
+	if err != nil {
+		writeApiResp(w, http.StatusBadRequest, 0, &apiErrResp{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	srvName := r.PathValue("name")
+	for {
+		srv, srvIndex, viewIndex := p.view.get(srvName)
+		if srvIndex <= index && ctx.Err() == nil {
+			p.view.wait(ctx, viewIndex)
+			continue
+		}
+
+		if srv == nil {
+			writeApiResp(w, http.StatusNotFound, srvIndex, &apiErrResp{
+				Index: srvIndex,
+				Error: discovery.ErrSrvNotFound.Error(),
+			})
+			return
+		}
+
+		writeApiResp(w, http.StatusOK, srvIndex, &discoverSrvResp{
+			Index: srvIndex,
+			Srv:   srv,
+		})
+		return
+	}
+}
+
+func (p *Proxy) handleWatch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeApiResp(w, http.StatusInternalServerError, 0, &apiErrResp{Error: "streaming unsupported"})
+		return
+	}
+
+	evtCh, err := p.view.watch(r.Context(), r.URL.Query()["srv"])
+	if err != nil {
+		writeApiResp(w, http.StatusInternalServerError, 0, &apiErrResp{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAliveTk := time.NewTicker(sseKeepAliveInterval)
+	defer keepAliveTk.Stop()
+
+	for {
+		select {
+		case evt, ok := <-evtCh:
+			if !ok {
+				return
+			}
+
+			// snapshots delivered first have no revision
+			index := evt.Revision
+			if index == 0 {
+				_, index, _ = p.view.get(evt.Srv.SrvName)
+			}
+
+			evtName := "updated"
+			if evt.Evt == discovery.EvtDeleted {
+				evtName = "deleted"
+			}
+
+			data, err := json.Marshal(&apiWatchEvt{
+				Index: index,
+				Evt:   evtName,
+				Srv:   evt.Srv,
+			})
+			if err != nil {
+				log.Logger.Error(nil, err)
+				continue
+			}
+
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", index, evtName, data); err != nil {
+				return
+			}
+		case <-keepAliveTk.C:
+			if _, err = fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// listenApi listens on the address and unix socket of the query API, none if neither is set.
+func (p *Proxy) listenApi() ([]net.Listener, error) {
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
+
+	if p.apiAddr != "" {
+		listener, err := net.Listen("tcp", p.apiAddr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if p.apiUnixSocket != "" {
+		// the socket left by a crashed proxy is removed, the one still served is not
+		if conn, err := net.Dial("unix", p.apiUnixSocket); err == nil {
+			_ = conn.Close()
+			closeAll()
+			return nil, fmt.Errorf("unix socket %s is in use", p.apiUnixSocket)
+		}
+		if err := os.Remove(p.apiUnixSocket); err != nil && !os.IsNotExist(err) {
+			closeAll()
+			return nil, err
+		}
+
+		listener, err := net.Listen("unix", p.apiUnixSocket)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+
+		// clients of the socket run as other users usually
+		if err = os.Chmod(p.apiUnixSocket, 0666); err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+
+	return listeners, nil
+}
+
+// serveApi serves the query API on listeners until runDoneCh closed.
+func (p *Proxy) serveApi(eg *errgroup.Group, listeners []net.Listener, runDoneCh chan struct{}) {
+	apiCtx, cancelApi := context.WithCancel(context.Background())
+	server := &http.Server{
+		Handler: p.Handler(),
+		// long polling and streaming requests end once stopped
+		BaseContext: func(net.Listener) context.Context {
+			return apiCtx
+		},
+	}
+
+	for _, listener := range listeners {
+		listener := listener
+		eg.Go(func() error {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Logger.Error(nil, err)
+			}
+			return nil
+		})
+	}
+
+	eg.Go(func() error {
+		<-runDoneCh
+		cancelApi()
+
+		ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Logger.Error(nil, err)
+		}
+		return nil
+	})
+}
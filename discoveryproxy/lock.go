@@ -0,0 +1,56 @@
+package discoveryproxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LockFileName is the PID/lock file in the cache directory, held by the proxy writing the directory.
+const LockFileName = ".discoveryproxy.pid"
+
+var (
+	ErrDirLocked = errors.New("cache directory locked by another proxy")
+
+	errLocked = errors.New("locked")
+)
+
+// DirLock makes sure only one proxy writes a cache directory at a time.
+type DirLock struct {
+	fp *os.File
+}
+
+// LockDir locks dir, created if not existed, and writes pid of the process into its lock file. It fails with
+// ErrDirLocked if another proxy holds the lock.
+func LockDir(dir string) (*DirLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	lockFilePath := filepath.Join(dir, LockFileName)
+	fp, err := openLockFile(lockFilePath)
+	if err != nil {
+		if err != errLocked {
+			return nil, err
+		}
+		pid, _ := os.ReadFile(lockFilePath)
+		return nil, fmt.Errorf("%w, dir:%s, pid:%s", ErrDirLocked, dir, strings.TrimSpace(string(pid)))
+	}
+
+	if err = fp.Truncate(0); err == nil {
+		_, err = fp.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		_ = closeLockFile(fp)
+		return nil, err
+	}
+
+	return &DirLock{fp: fp}, nil
+}
+
+func (l *DirLock) Unlock() error {
+	return closeLockFile(l.fp)
+}
@@ -0,0 +1,37 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package discoveryproxy
+
+import (
+	"os"
+	"syscall"
+)
+
+// openLockFile locks the file by flock, the lock is released by the system even if the process crashed.
+func openLockFile(path string) (*os.File, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = fp.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+
+	return fp, nil
+}
+
+// closeLockFile empties the file and releases the lock. The file is kept, removing it races with proxies opening
+// it to lock.
+func closeLockFile(fp *os.File) error {
+	err := fp.Truncate(0)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,27 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package discoveryproxy
+
+import "os"
+
+// openLockFile locks by creating the file exclusively, it must be removed by hand if the process crashed.
+func openLockFile(path string) (*os.File, error) {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return fp, nil
+}
+
+// closeLockFile removes the file to release the lock.
+func closeLockFile(fp *os.File) error {
+	err := fp.Close()
+	if removeErr := os.Remove(fp.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -2,20 +2,36 @@ package discoveryproxy
 
 import (
 	"context"
-	"encoding/json"
 	"github.com/995933447/microgosuit/discovery"
 	"github.com/995933447/microgosuit/env"
 	"github.com/995933447/microgosuit/factory"
 	"github.com/995933447/microgosuit/log"
 	"github.com/995933447/reflectutil"
-	"github.com/coreos/etcd/pkg/ioutil"
 	"golang.org/x/sync/errgroup"
 	"os"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func NewProxy(discoverKeyPrefix string) (*Proxy, error) {
+type Option func(*Proxy)
+
+// WithDir caches services in dir instead of the cache directory in meta.
+func WithDir(dir string) Option {
+	return func(p *Proxy) {
+		p.dir = dir
+	}
+}
+
+// WithApiUnixSocket serves the query API on the unix socket instead of the one in meta.
+func WithApiUnixSocket(path string) Option {
+	return func(p *Proxy) {
+		p.apiUnixSocket = path
+	}
+}
+
+func NewProxy(discoverKeyPrefix string, opts ...Option) (*Proxy, error) {
 	discover, err := factory.NewSpecDiscovery(discoverKeyPrefix, env.MustMeta().DiscoveryProxy.Conn)
 	if err != nil {
 		return nil, err
@@ -25,6 +41,15 @@ func NewProxy(discoverKeyPrefix string) (*Proxy, error) {
 		dir:               env.MustMeta().DiscoveryProxy.Dir,
 		discover:          discover,
 		discoverKeyPrefix: discoverKeyPrefix,
+		stopOrRerunSignCh: make(chan struct{}, 1),
+		exitSignCh:        make(chan struct{}),
+		view:              newView(),
+		apiAddr:           env.MustMeta().DiscoveryProxy.ApiAddr,
+		apiUnixSocket:     env.MustMeta().DiscoveryProxy.ApiUnixSocket,
+	}
+	proxy.staleFileGrace.Store(int64(env.MustMeta().DiscoveryProxy.GetStaleFileGrace()))
+	for _, opt := range opts {
+		opt(proxy)
 	}
 
 	go func() {
@@ -34,15 +59,23 @@ func NewProxy(discoverKeyPrefix string) (*Proxy, error) {
 	return proxy, nil
 }
 
+// connCfg returns the config the discovery of driver conn is made by, it's the config section of the driver in
+// meta, and the etcd section for the etcd driver as well.
+func connCfg(conn string) interface{} {
+	meta := env.MustMeta()
+	if conn == env.DiscoveryEtcd {
+		return []interface{}{meta.Etcd, meta.Drivers[conn]}
+	}
+	return meta.Drivers[conn]
+}
+
 func watchCfg(proxy *Proxy) {
 	var (
 		oldCfg     env.DiscoveryProxy
-		oldConnCfg interface{}
+		oldConnCfg = connCfg(env.MustMeta().DiscoveryProxy.Conn)
+		cfgDir     = env.MustMeta().DiscoveryProxy.Dir
+		refusedDir string
 	)
-	switch env.MustMeta().DiscoveryProxy.Conn {
-	case env.DiscoveryEtcd:
-		oldConnCfg = env.MustMeta().Etcd
-	}
 	if err := reflectutil.CopySameFields(env.MustMeta().DiscoveryProxy, &oldCfg); err != nil {
 		log.Logger.Error(nil, err)
 	}
@@ -51,113 +84,157 @@ func watchCfg(proxy *Proxy) {
 		refreshCfgTk := time.NewTicker(3 * time.Second)
 		defer refreshCfgTk.Stop()
 		for {
-			if proxy.isExited {
-				break
+			select {
+			case <-proxy.exitSignCh:
+				return
+			case <-refreshCfgTk.C:
 			}
 
-			<-refreshCfgTk.C
-
 			cfg := env.MustMeta().DiscoveryProxy
-			if cfg.Conn == oldCfg.Conn && cfg.Dir == oldCfg.Dir {
-				var isDiff bool
-
-				switch cfg.Conn {
-				case env.DiscoveryEtcd:
-					connCfg := env.MustMeta().Etcd
-					if connCfg.ConnectTimeoutMs != oldConnCfg.(env.Etcd).ConnectTimeoutMs {
-						isDiff = true
-						break
-					}
-
-					if len(connCfg.Endpoints) != len(oldConnCfg.(env.Etcd).Endpoints) {
-						isDiff = true
-						break
-					}
-
-					for _, endpoint := range connCfg.Endpoints {
-						var existed bool
-
-						for _, oldEndpoint := range oldConnCfg.(env.Etcd).Endpoints {
-							if endpoint != oldEndpoint {
-								continue
-							}
-							existed = true
-							break
-						}
-
-						if !existed {
-							isDiff = true
-							oldConnCfg = connCfg
-							break
-						}
-					}
-				default:
-					log.Logger.Error(nil, "no support discovery type:"+cfg.Conn)
-				}
+			proxy.staleFileGrace.Store(int64(cfg.GetStaleFileGrace()))
 
-				if !isDiff {
-					continue
-				}
+			// the cache directory is locked by Run, moving it needs a restart
+			if cfg.Dir != cfgDir && cfg.Dir != refusedDir {
+				refusedDir = cfg.Dir
+				log.Logger.Errorf(nil, "change of cache directory from %s to %s is ignored until restarted", proxy.dir, cfg.Dir)
 			}
 
-			discover, err := factory.GetOrMakeDiscovery(proxy.discoverKeyPrefix)
+			newConnCfg := connCfg(cfg.Conn)
+			if cfg.Conn == oldCfg.Conn && reflect.DeepEqual(newConnCfg, oldConnCfg) {
+				continue
+			}
+
+			// a new instance connected by the new config, the factory shares its instances with others
+			discover, err := factory.NewSpecDiscovery(proxy.discoverKeyPrefix, cfg.Conn)
 			if err != nil {
 				log.Logger.Error(nil, err)
 				continue
 			}
-			proxy.discover = discover
-			proxy.dir = cfg.Dir
 
-			proxy.mu.RLock()
+			proxy.mu.Lock()
 			if proxy.isExited {
-				proxy.mu.RUnlock()
-				break
+				proxy.mu.Unlock()
+				if err = discover.Close(context.Background()); err != nil {
+					log.Logger.Error(nil, err)
+				}
+				return
 			}
+			proxy.retired = append(proxy.retired, proxy.discover)
+			proxy.discover = discover
 			proxy.rerun()
-			proxy.mu.RUnlock()
+			proxy.mu.Unlock()
 
 			oldCfg = env.DiscoveryProxy{}
 			if err = reflectutil.CopySameFields(cfg, &oldCfg); err != nil {
 				log.Logger.Error(nil, err)
 			}
+			oldConnCfg = newConnCfg
 		}
 	}()
 }
 
 type Proxy struct {
+	// dir is locked by Run, it's never changed at runtime
 	dir               string
-	discover          discovery.Discovery
 	discoverKeyPrefix string
 
-	mu                sync.RWMutex
+	mu sync.RWMutex
+	// discover is replaced once the connection config changed, the replaced ones are retired until closed after
+	// Run stopped using them
+	discover          discovery.Discovery
+	retired           []discovery.Discovery
 	isExited          bool
 	stopOrRerunSignCh chan struct{}
 	exitSignCh        chan struct{}
+	stopOnce          sync.Once
+	runWg             sync.WaitGroup
+	// staleFileGrace is how long cache files of removed services are kept before removed
+	staleFileGrace atomic.Int64
+	view           *view
+	apiAddr        string
+	apiUnixSocket  string
 	discovery.FileCachedProxyContract
 }
 
+func (p *Proxy) getDiscover() discovery.Discovery {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.discover
+}
+
+// closeRetired closes the discoveries replaced by new config.
+func (p *Proxy) closeRetired(ctx context.Context) error {
+	p.mu.Lock()
+	retired := p.retired
+	p.retired = nil
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, discover := range retired {
+		if err := discover.Close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// rerun makes Run resync all services, a pending one is enough if Run is busy.
 func (p *Proxy) rerun() {
-	p.stopOrRerunSignCh <- struct{}{}
+	select {
+	case p.stopOrRerunSignCh <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Proxy) syncSrv(evt *discovery.WatchEvt) {
+	switch evt.Evt {
+	case discovery.EvtUpdated:
+		if err := p.SyncSrvToLocalFile(evt.Srv, evt.Revision); err != nil {
+			log.Logger.Error(nil, err)
+		}
+	case discovery.EvtDeleted:
+		err := os.Remove(p.getSrvFilePath(evt.Srv.SrvName))
+		if err != nil && !os.IsNotExist(err) {
+			log.Logger.Error(nil, err)
+		}
+	}
+	p.view.update(evt)
 }
 
+// Run syncs services in discovery to the cache directory until stopped by Stop.
 func (p *Proxy) Run() error {
-	p.discover.OnSrvUpdated(func(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {
-		switch evt {
-		case discovery.EvtUpdated:
-			if err := p.SyncSrvToLocalFile(srv); err != nil {
-				log.Logger.Error(nil, err)
-			}
-		case discovery.EvtDeleted:
-			err := os.Remove(p.getSrvFilePath(srv.SrvName))
-			if err != nil {
-				log.Logger.Error(nil, err)
-			}
+	p.mu.Lock()
+	if p.isExited {
+		p.mu.Unlock()
+		return nil
+	}
+	p.runWg.Add(1)
+	p.mu.Unlock()
+	defer p.runWg.Done()
+
+	dirLock, err := LockDir(p.dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dirLock.Unlock(); err != nil {
+			log.Logger.Error(nil, err)
 		}
-	})
+	}()
+
+	listeners, err := p.listenApi()
+	if err != nil {
+		return err
+	}
 
 	var eg errgroup.Group
 
+	runDoneCh := make(chan struct{})
+	p.serveApi(&eg, listeners, runDoneCh)
+
 	eg.Go(func() error {
+		defer close(runDoneCh)
 		for {
 			p.mu.RLock()
 			if p.isExited {
@@ -166,21 +243,53 @@ func (p *Proxy) Run() error {
 			}
 			p.mu.RUnlock()
 
-			if _, err := p.discover.LoadAll(context.Background()); err != nil {
+			// watching all services loads them all first, so every rerun is a full resync
+			discover := p.getDiscover()
+			resyncAt := time.Now()
+			ctx, cancel := context.WithCancel(context.Background())
+			evtCh, err := discover.Watch(ctx)
+			if err != nil {
+				cancel()
 				return err
 			}
 
+			syncDoneCh := make(chan struct{})
+			go func() {
+				defer close(syncDoneCh)
+				for evt := range evtCh {
+					p.syncSrv(evt)
+				}
+			}()
+
+			gcDoneCh := make(chan struct{})
+			go func() {
+				defer close(gcDoneCh)
+				p.gcStaleFiles(ctx, discover, resyncAt)
+			}()
+
 			<-p.stopOrRerunSignCh
+
+			cancel()
+			<-syncDoneCh
+			<-gcDoneCh
+
+			if err = p.closeRetired(context.Background()); err != nil {
+				log.Logger.Error(nil, err)
+			}
 		}
 		return nil
 	})
 
 	eg.Go(func() error {
-		<-p.exitSignCh
+		select {
+		case <-p.exitSignCh:
+		case <-runDoneCh:
+			return nil
+		}
 		p.mu.Lock()
 		p.isExited = true
-		p.stopOrRerunSignCh <- struct{}{}
 		p.mu.Unlock()
+		p.rerun()
 		return nil
 	})
 
@@ -191,17 +300,166 @@ func (p *Proxy) Run() error {
 	return nil
 }
 
-func (p *Proxy) SyncSrvToLocalFile(srv *discovery.Service) error {
-	path := p.FileCachedProxyContract.GetCacheFilePathBySrv(p.dir, srv.SrvName)
-	srvJson, err := json.Marshal(srv)
-	if err != nil {
-		return err
+// Stop makes Run return and waits for it until ctx done, then closes the discoveries made by the proxy. Proxy
+// can't be run again after stopped.
+func (p *Proxy) Stop(ctx context.Context) error {
+	p.stopOnce.Do(func() {
+		p.mu.Lock()
+		p.isExited = true
+		p.mu.Unlock()
+		close(p.exitSignCh)
+		p.view.watchers.CloseAll()
+	})
+
+	doneCh := make(chan struct{})
+	go func() {
+		p.runWg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	p.mu.Lock()
+	if p.discover != nil {
+		p.retired = append(p.retired, p.discover)
+		p.discover = nil
+	}
+	p.mu.Unlock()
+
+	return p.closeRetired(ctx)
+}
+
+// staleFileGcRetryInterval is the interval to reconcile the cache directory again after failed.
+const staleFileGcRetryInterval = 5 * time.Second
+
+// gcStaleFiles removes cache files of services removed from discovery, e.g. while the proxy was down, which are
+// never deleted by watching. It keeps reconciling until no orphaned files are left or ctx is done, resyncAt is
+// when the rerun watching all services by discover started.
+func (p *Proxy) gcStaleFiles(ctx context.Context, discover discovery.Discovery, resyncAt time.Time) {
+	orphanedAt := map[string]time.Time{}
+	for {
+		next, err := p.reconcileCacheDir(ctx, discover, resyncAt, orphanedAt)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Logger.Error(ctx, err)
+			next = staleFileGcRetryInterval
+		}
+
+		if next == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
 	}
-	err = ioutil.WriteAndSyncFile(path, srvJson, 0666)
+}
+
+// reconcileCacheDir reconciles the cache directory against the view. Services not synced to the view since
+// resyncAt are checked by discovery one by one, cache files of the ones not found are removed once orphaned for
+// the grace period, orphanedAt keeps when they were found orphaned. It returns how long to wait until the next
+// orphaned file expires, 0 if there is none.
+func (p *Proxy) reconcileCacheDir(ctx context.Context, discover discovery.Discovery, resyncAt time.Time, orphanedAt map[string]time.Time) (time.Duration, error) {
+	files, err := os.ReadDir(p.dir)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+
+	cached := map[string]struct{}{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if srvName, ok := p.IsCacheFile(file.Name()); ok {
+			cached[srvName] = struct{}{}
+		}
+	}
+
+	var (
+		grace    = time.Duration(p.staleFileGrace.Load())
+		now      = time.Now()
+		next     time.Duration
+		orphaned = map[string]struct{}{}
+	)
+	schedule := func(wait time.Duration) {
+		if next == 0 || wait < next {
+			next = wait
+		}
+	}
+	for srvName := range p.view.unsynced(cached, resyncAt) {
+		checkedAt := time.Now()
+		if _, err = discover.Discover(ctx, srvName); err == nil {
+			continue
+		}
+		if err != discovery.ErrSrvNotFound {
+			return 0, err
+		}
+
+		p.view.remove(srvName, checkedAt)
+
+		if _, ok := cached[srvName]; !ok {
+			continue
+		}
+
+		filePath := p.getSrvFilePath(srvName)
+		info, err := os.Stat(filePath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Logger.Error(ctx, err)
+			}
+			continue
+		}
+
+		orphaned[srvName] = struct{}{}
+
+		since, ok := orphanedAt[srvName]
+		if !ok {
+			since = now
+			orphanedAt[srvName] = now
+		}
+
+		wait := grace - now.Sub(since)
+		// the file written after checked may be of a service created since then
+		if wait <= 0 && !info.ModTime().Before(checkedAt) {
+			wait = staleFileGcRetryInterval
+		}
+
+		if wait > 0 {
+			schedule(wait)
+			continue
+		}
+
+		if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Logger.Error(ctx, err)
+			schedule(staleFileGcRetryInterval)
+			continue
+		}
+
+		delete(orphanedAt, srvName)
+		log.Logger.Warnf(ctx, "removed stale cache file %s, service %s not in discovery since %s", filePath, srvName, since.Format(time.RFC3339))
+	}
+
+	for srvName := range orphanedAt {
+		if _, ok := orphaned[srvName]; !ok {
+			delete(orphanedAt, srvName)
+		}
+	}
+
+	return next, nil
+}
+
+// SyncSrvToLocalFile replaces the cache file of srv atomically, revision is the revision of discovery srv is
+// loaded at.
+func (p *Proxy) SyncSrvToLocalFile(srv *discovery.Service, revision int64) error {
+	return p.FileCachedProxyContract.WriteCacheFile(p.dir, srv, revision)
 }
 
 func (p *Proxy) getSrvFilePath(srvName string) string {
@@ -0,0 +1,507 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/filecachedproxy"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+	"github.com/995933447/microgosuit/discoveryproxy"
+	"github.com/995933447/microgosuit/env"
+	"github.com/995933447/microgosuit/factory"
+)
+
+var (
+	initMetaOnce sync.Once
+	metaFilePath string
+)
+
+// initMeta inits meta of the proxy connected to the memory discovery, it's done once since meta is kept by the
+// process.
+func initMeta(t *testing.T) {
+	t.Helper()
+	initMetaOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "microgosuit_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metaFilePath = filepath.Join(dir, "meta.json")
+		writeMeta(t, func(*env.Meta) {})
+		if err = env.InitMeta(metaFilePath); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// writeMeta writes meta changed by fn to the meta file, which is reloaded by the process in 5s.
+func writeMeta(t *testing.T, fn func(meta *env.Meta)) {
+	t.Helper()
+	meta := &env.Meta{
+		Env:       env.Test,
+		Discovery: env.DiscoveryMemory,
+		DiscoveryProxy: env.DiscoveryProxy{
+			Dir:               filepath.Join(filepath.Dir(metaFilePath), "cache"),
+			Conn:              env.DiscoveryMemory,
+			StaleFileGraceSec: 1,
+		},
+	}
+	fn(meta)
+	metaJson, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(metaFilePath, metaJson, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newKeyPrefix returns the key prefix of the test unique per run, so its proxies connect to their own memory
+// discovery, which is shared by the process.
+func newKeyPrefix(t *testing.T) string {
+	return fmt.Sprintf("%s/%d/", t.Name(), time.Now().UnixNano())
+}
+
+func waitCacheFile(t *testing.T, cacheDir, srvName string, existed bool) {
+	t.Helper()
+	var contract discovery.FileCachedProxyContract
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(contract.GetCacheFilePathBySrv(cacheDir, srvName))
+		if (err == nil) == existed {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wait cache file of %s existed %v timeout, err:%v", srvName, existed, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// runProxy runs a proxy of keyPrefix caching services in cacheDir, the proxy is stopped by the function returned.
+func runProxy(t *testing.T, keyPrefix, cacheDir string, opts ...discoveryproxy.Option) func() {
+	t.Helper()
+	proxy, err := discoveryproxy.NewProxy(keyPrefix, append([]discoveryproxy.Option{discoveryproxy.WithDir(cacheDir)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- proxy.Run()
+	}()
+	return func() {
+		t.Helper()
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stopCancel()
+		if err := proxy.Stop(stopCtx); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-runErrCh:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("proxy still running after stopped")
+		}
+	}
+}
+
+func TestDiscoveryProxy(t *testing.T) {
+	initMeta(t)
+
+	ctx := context.Background()
+
+	keyPrefix, cacheDir, sockPath := newKeyPrefix(t), t.TempDir(), filepath.Join(t.TempDir(), "api.sock")
+	registry := memory.GetOrNewShared(keyPrefix)
+	defer registry.Close(ctx)
+	if err := registry.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+
+	// removed while the proxy was down
+	var contract discovery.FileCachedProxyContract
+	if err := contract.WriteCacheFile(cacheDir, &discovery.Service{SrvName: "logv4"}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := runProxy(t, keyPrefix, cacheDir, discoveryproxy.WithApiUnixSocket(sockPath))
+
+	waitCacheFile(t, cacheDir, "logv3", true)
+
+	// the directory is locked by the running proxy
+	if _, err := discoveryproxy.LockDir(cacheDir); !errors.Is(err, discoveryproxy.ErrDirLocked) {
+		t.Fatalf("expect ErrDirLocked, got %v", err)
+	}
+
+	client := filecachedproxy.NewDiscovery(cacheDir, memory.NewDiscovery())
+	defer client.Close(ctx)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	evtCh, err := client.Watch(watchCtx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitNodes := func(n int) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case evt, ok := <-evtCh:
+				if !ok {
+					t.Fatal("watch channel closed")
+				}
+				if len(evt.Srv.Nodes) == n {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("wait %d nodes timeout", n)
+			}
+		}
+	}
+
+	waitNodes(1)
+
+	if err = registry.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12015)); err != nil {
+		t.Fatal(err)
+	}
+	waitNodes(2)
+
+	waitCacheFile(t, cacheDir, "logv4", false)
+
+	testQueryApi(t, sockPath, registry)
+
+	stop()
+
+	dirLock, err := discoveryproxy.LockDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = dirLock.Unlock()
+}
+
+func TestDiscoveryProxyGcStaleFiles(t *testing.T) {
+	initMeta(t)
+
+	ctx := context.Background()
+
+	keyPrefix, cacheDir := newKeyPrefix(t), t.TempDir()
+	registry := memory.GetOrNewShared(keyPrefix)
+	defer registry.Close(ctx)
+	if err := registry.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+
+	// left by the last run, logv4 is removed while the proxy was down
+	var contract discovery.FileCachedProxyContract
+	for _, srvName := range []string{"logv3", "logv4"} {
+		if err := contract.WriteCacheFile(cacheDir, &discovery.Service{SrvName: srvName}, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reads the files left before the proxy runs
+	client := filecachedproxy.NewDiscovery(cacheDir, memory.NewDiscovery())
+	defer client.Close(ctx)
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	evtCh, err := client.Watch(watchCtx, "logv3", "logv4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := runProxy(t, keyPrefix, cacheDir)
+	defer stop()
+
+	// the orphan is kept until the grace period of 1s expires
+	time.Sleep(500 * time.Millisecond)
+	waitCacheFile(t, cacheDir, "logv4", true)
+
+	waitCacheFile(t, cacheDir, "logv4", false)
+
+	// the client sees the resync of the live service and the removal of the orphan
+	var isSynced, isRemoved bool
+	timeout := time.After(5 * time.Second)
+	for !isSynced || !isRemoved {
+		select {
+		case evt, ok := <-evtCh:
+			if !ok {
+				t.Fatal("watch channel closed")
+			}
+			switch evt.Srv.SrvName {
+			case "logv3":
+				if evt.Evt == discovery.EvtDeleted {
+					t.Fatalf("expect the live service never removed, got %+v", evt)
+				}
+				isSynced = len(evt.Srv.Nodes) == 1
+			case "logv4":
+				isRemoved = evt.Evt == discovery.EvtDeleted
+			}
+		case <-timeout:
+			t.Fatalf("wait the client synced timeout, synced %v, removed %v", isSynced, isRemoved)
+		}
+	}
+	if _, err = client.Discover(ctx, "logv4"); err != discovery.ErrSrvNotFound {
+		t.Fatalf("expect ErrSrvNotFound of the orphan, got %v", err)
+	}
+
+	// the live service is never removed
+	time.Sleep(1500 * time.Millisecond)
+	srv, _, err := contract.ReadCacheFile(cacheDir, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Nodes) != 1 {
+		t.Fatalf("unexpected nodes %+v", srv.Nodes)
+	}
+	if srv, err = client.Discover(ctx, "logv3"); err != nil || len(srv.Nodes) != 1 {
+		t.Fatalf("unexpected service seen by the client %+v, err:%v", srv, err)
+	}
+}
+
+func TestDiscoveryProxyRestart(t *testing.T) {
+	initMeta(t)
+
+	ctx := context.Background()
+
+	keyPrefix, cacheDir := newKeyPrefix(t), t.TempDir()
+	registry := memory.GetOrNewShared(keyPrefix)
+	defer registry.Close(ctx)
+	for _, port := range []int{12014, 12015} {
+		if err := registry.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := runProxy(t, keyPrefix, cacheDir)
+	waitCacheFile(t, cacheDir, "logv3", true)
+
+	client := filecachedproxy.NewDiscovery(cacheDir, memory.NewDiscovery())
+	defer client.Close(ctx)
+	waitNodes := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			srv, err := client.Discover(ctx, "logv3")
+			if err == nil && len(srv.Nodes) == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("wait %d nodes timeout, got %+v, err:%v", n, srv, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitNodes(2)
+
+	// changed while the proxy is down, the client keeps reading the files synced last
+	stop()
+	if err := registry.Unregister(ctx, "logv3", discovery.NewNode("127.2.1.1", 12015), true); err != nil {
+		t.Fatal(err)
+	}
+	waitNodes(2)
+
+	// rerun on the same directory, the snapshot synced is never older than the files synced by the last run
+	stop = runProxy(t, keyPrefix, cacheDir)
+	defer stop()
+	waitNodes(1)
+
+	var contract discovery.FileCachedProxyContract
+	_, rev, err := contract.ReadCacheFile(cacheDir, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev == 0 {
+		t.Fatal("expect the snapshot synced at the revision loaded")
+	}
+}
+
+const customConn = "test_proxy_conn"
+
+var (
+	registerCustomConnOnce sync.Once
+	customConnCalls        atomic.Int32
+)
+
+func TestDiscoveryProxyReconnect(t *testing.T) {
+	initMeta(t)
+
+	// connects to the memory discovery as well, so other proxies are not affected by the conn in meta
+	registerCustomConnOnce.Do(func() {
+		factory.RegisterDriver(customConn, func(keyPrefix string, _ json.RawMessage) (discovery.Discovery, error) {
+			customConnCalls.Add(1)
+			return memory.GetOrNewShared(keyPrefix), nil
+		})
+	})
+	defer writeMeta(t, func(*env.Meta) {})
+
+	ctx := context.Background()
+
+	keyPrefix, cacheDir := newKeyPrefix(t), t.TempDir()
+	registry := memory.GetOrNewShared(keyPrefix)
+	defer registry.Close(ctx)
+	if err := registry.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := runProxy(t, keyPrefix, cacheDir)
+	defer stop()
+	waitCacheFile(t, cacheDir, "logv3", true)
+
+	// meta is reloaded in 5s and checked by the proxy every 3s
+	waitCalls := func(n int32) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for customConnCalls.Load() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("wait connected %d times timeout, got %d", n, customConnCalls.Load())
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	customConnCalls.Store(0)
+	writeMeta(t, func(meta *env.Meta) {
+		meta.DiscoveryProxy.Conn = customConn
+		meta.Drivers = map[string]json.RawMessage{customConn: json.RawMessage(`{"v":1}`)}
+	})
+	waitCalls(1)
+
+	// connected again once the config section of the driver changed
+	writeMeta(t, func(meta *env.Meta) {
+		meta.DiscoveryProxy.Conn = customConn
+		meta.Drivers = map[string]json.RawMessage{customConn: json.RawMessage(`{"v":2}`)}
+	})
+	waitCalls(2)
+
+	// kept while the config unchanged
+	time.Sleep(4 * time.Second)
+	if n := customConnCalls.Load(); n != 2 {
+		t.Fatalf("expect connected 2 times, got %d", n)
+	}
+
+	if err := registry.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12015)); err != nil {
+		t.Fatal(err)
+	}
+	var contract discovery.FileCachedProxyContract
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv, _, err := contract.ReadCacheFile(cacheDir, "logv3")
+		if err == nil && len(srv.Nodes) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wait synced by the new connection timeout, got %+v, err:%v", srv, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func testQueryApi(t *testing.T, sockPath string, registry discovery.Discovery) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", sockPath)
+			},
+		},
+	}
+
+	get := func(path string, resp interface{}) int {
+		t.Helper()
+		httpResp, err := client.Get("http://proxy" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer httpResp.Body.Close()
+		if err = json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+			t.Fatal(err)
+		}
+		return httpResp.StatusCode
+	}
+
+	var listResp struct {
+		Index    int64                `json:"index"`
+		Services []*discovery.Service `json:"services"`
+	}
+	if get("/v1/services", &listResp); len(listResp.Services) != 1 || listResp.Services[0].SrvName != "logv3" {
+		t.Fatalf("unexpected services %+v", listResp.Services)
+	}
+
+	type discoverResp struct {
+		Index int64              `json:"index"`
+		Srv   *discovery.Service `json:"srv"`
+	}
+	var srvResp discoverResp
+	if code := get("/v1/services/logv3", &srvResp); code != http.StatusOK || len(srvResp.Srv.Nodes) != 2 {
+		t.Fatalf("unexpected response %d %+v", code, srvResp.Srv)
+	}
+	if code := get("/v1/services/logv5", &struct{}{}); code != http.StatusNotFound {
+		t.Fatalf("expect not found, got %d", code)
+	}
+
+	// long polling until changed
+	respCh := make(chan discoverResp, 1)
+	go func() {
+		var resp discoverResp
+		get(fmt.Sprintf("/v1/services/logv3?index=%d&wait=5s", srvResp.Index), &resp)
+		respCh <- resp
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := registry.Register(context.Background(), "logv3", discovery.NewNode("127.2.1.1", 12016)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case resp := <-respCh:
+		if resp.Index <= srvResp.Index || len(resp.Srv.Nodes) != 3 {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("long polling timeout")
+	}
+
+	httpResp, err := client.Get("http://proxy/v1/watch?srv=logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpResp.Body.Close()
+	if contentType := httpResp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", contentType)
+	}
+
+	reader := bufio.NewReader(httpResp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var evt struct {
+			Evt string             `json:"evt"`
+			Srv *discovery.Service `json:"srv"`
+		}
+		if err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &evt); err != nil {
+			t.Fatal(err)
+		}
+		if evt.Evt != "updated" || len(evt.Srv.Nodes) != 3 {
+			t.Fatalf("unexpected event %+v", evt)
+		}
+		break
+	}
+}
@@ -0,0 +1,173 @@
+package discoveryproxy
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/util"
+)
+
+// view is the in-memory view of services in discovery kept by the proxy, the query API is served by it. Changes
+// are indexed by the view itself, since revisions of discovery are lost across reruns.
+type view struct {
+	mu        sync.RWMutex
+	index     int64
+	services  map[string]*viewSrv
+	changedCh chan struct{}
+	watchers  *util.Watchers
+}
+
+type viewSrv struct {
+	srv       *discovery.Service
+	index     int64
+	updatedAt time.Time
+}
+
+func newView() *view {
+	return &view{
+		services:  map[string]*viewSrv{},
+		changedCh: make(chan struct{}),
+		watchers:  util.NewWatchers(),
+	}
+}
+
+// update applies evt synced from discovery, the same service synced again by a resync changes nothing.
+func (v *view) update(evt *discovery.WatchEvt) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	srvName := evt.Srv.SrvName
+	before, ok := v.services[srvName]
+
+	switch evt.Evt {
+	case discovery.EvtUpdated:
+		var beforeSrv *discovery.Service
+		if ok {
+			if reflect.DeepEqual(before.srv, evt.Srv) {
+				before.updatedAt = time.Now()
+				return
+			}
+			beforeSrv = before.srv
+		}
+		v.index++
+		v.services[srvName] = &viewSrv{
+			srv:       evt.Srv,
+			index:     v.index,
+			updatedAt: time.Now(),
+		}
+		v.changed(discovery.NewWatchEvt(discovery.EvtUpdated, beforeSrv, evt.Srv, v.index))
+	case discovery.EvtDeleted:
+		if ok {
+			v.delete(before)
+		}
+	}
+}
+
+// unsynced returns services in the view and ones of srvNames, which are not updated since resyncAt. They are not
+// known to be in discovery, since every service in discovery is updated by the snapshot of the rerun at resyncAt.
+func (v *view) unsynced(srvNames map[string]struct{}, resyncAt time.Time) map[string]struct{} {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	unsynced := map[string]struct{}{}
+	for srvName, vs := range v.services {
+		if vs.updatedAt.Before(resyncAt) {
+			unsynced[srvName] = struct{}{}
+		}
+	}
+	for srvName := range srvNames {
+		if vs, ok := v.services[srvName]; !ok || vs.updatedAt.Before(resyncAt) {
+			unsynced[srvName] = struct{}{}
+		}
+	}
+
+	return unsynced
+}
+
+// remove deletes srvName not found in discovery at checkedAt, unless it's updated since then.
+func (v *view) remove(srvName string, checkedAt time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if vs, ok := v.services[srvName]; ok && vs.updatedAt.Before(checkedAt) {
+		v.delete(vs)
+	}
+}
+
+// delete must be called with mu held.
+func (v *view) delete(vs *viewSrv) {
+	v.index++
+	delete(v.services, vs.srv.SrvName)
+	v.changed(discovery.NewWatchEvt(discovery.EvtDeleted, vs.srv, &discovery.Service{
+		SrvName: vs.srv.SrvName,
+	}, v.index))
+}
+
+// changed must be called with mu held, so subscribers see changes in order.
+func (v *view) changed(evt *discovery.WatchEvt) {
+	close(v.changedCh)
+	v.changedCh = make(chan struct{})
+	v.watchers.Publish(evt)
+}
+
+// list returns all services sorted by name and the index of the view.
+func (v *view) list() ([]*discovery.Service, int64) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	services := make([]*discovery.Service, 0, len(v.services))
+	for _, vs := range v.services {
+		services = append(services, vs.srv)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].SrvName < services[j].SrvName
+	})
+
+	return services, v.index
+}
+
+// get returns srvName with the index it's changed at, and the index of the view. srv is nil if it's not found,
+// the index of the view is returned as its index then.
+func (v *view) get(srvName string) (srv *discovery.Service, index, viewIndex int64) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	vs, ok := v.services[srvName]
+	if !ok {
+		return nil, v.index, v.index
+	}
+
+	return vs.srv, vs.index, v.index
+}
+
+// wait blocks until the view changed since index or ctx done.
+func (v *view) wait(ctx context.Context, index int64) {
+	v.mu.RLock()
+	changedCh := v.changedCh
+	changed := v.index > index
+	v.mu.RUnlock()
+
+	if changed {
+		return
+	}
+
+	select {
+	case <-changedCh:
+	case <-ctx.Done():
+	}
+}
+
+func (v *view) watch(ctx context.Context, srvNames []string) (<-chan *discovery.WatchEvt, error) {
+	return v.watchers.Watch(ctx, srvNames, func(_ context.Context) ([]*discovery.WatchEvt, error) {
+		services, index := v.list()
+		snapshots := make([]*discovery.WatchEvt, 0, len(services))
+		for _, srv := range services {
+			snapshots = append(snapshots, util.NewSnapshot(srv, index))
+		}
+		return snapshots, nil
+	})
+}
@@ -1,10 +1,13 @@
 package env
 
 import (
-	"github.com/995933447/confloader"
-	"github.com/995933447/microgosuit/log"
+	"encoding/json"
+	"os"
 	"sync"
 	"time"
+
+	"github.com/995933447/confloader"
+	"github.com/995933447/microgosuit/log"
 )
 
 const (
@@ -16,23 +19,51 @@ const (
 const (
 	DiscoveryFileCacheProxy = "proxy"
 	DiscoveryEtcd           = "etcd"
+	DiscoveryMemory         = "memory" // services are kept in process memory, for tests and local development
+)
+
+const (
+	EtcdLayoutNode    = "node"    // one key per node, the default
+	EtcdLayoutService = "service" // one key per service, only for transition from old versions
 )
 
 type Etcd struct {
 	ConnectTimeoutMs int32    `json:"connect_timeout_ms"`
 	Endpoints        []string `json:"endpoints"`
+	Layout           string   `json:"layout"`
 }
 
+// DefaultStaleFileGraceSec is the default of DiscoveryProxy.StaleFileGraceSec.
+const DefaultStaleFileGraceSec = 60
+
 type DiscoveryProxy struct {
 	Dir  string `json:"dir"`
 	Conn string `json:"connection"`
+	// StaleFileGraceSec is how long cache files of removed services are kept before removed, DefaultStaleFileGraceSec
+	// if it's not set.
+	StaleFileGraceSec int32 `json:"stale_file_grace_sec"`
+	// ApiAddr and ApiUnixSocket are where the proxy serves its query API for non-Go clients, not served if unset.
+	ApiAddr       string `json:"api_addr"`
+	ApiUnixSocket string `json:"api_unix_socket"`
 }
 
+func (p *DiscoveryProxy) GetStaleFileGrace() time.Duration {
+	if p.StaleFileGraceSec <= 0 {
+		return DefaultStaleFileGraceSec * time.Second
+	}
+	return time.Duration(p.StaleFileGraceSec) * time.Second
+}
+
+// ZoneEnvVar is the environment variable naming zone of the process if it's not set in meta.
+const ZoneEnvVar = "MICROGOSUIT_ZONE"
+
 type Meta struct {
 	Env            string `json:"env"`
 	Discovery      string `json:"discovery"`
+	Zone           string `json:"zone"` // availability zone the process is deployed in
 	Etcd           `json:"etcd"`
 	DiscoveryProxy `json:"discovery_proxy"`
+	Drivers        map[string]json.RawMessage `json:"drivers"` // config sections of discovery drivers keyed by driver name
 }
 
 func (m *Meta) IsDev() bool {
@@ -91,6 +122,19 @@ func InitMeta(cfgFilePath string) error {
 	return nil
 }
 
+// GetZone returns zone of the process from meta, or environment variable ZoneEnvVar if meta not init or no zone
+// set in it.
+func GetZone() string {
+	initMetaMu.RLock()
+	defer initMetaMu.RUnlock()
+
+	if meta != nil && meta.Zone != "" {
+		return meta.Zone
+	}
+
+	return os.Getenv(ZoneEnvVar)
+}
+
 func MustMeta() *Meta {
 	if meta == nil {
 		panic("meta not init")
@@ -1,68 +1,215 @@
 package factory
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/995933447/microgosuit/discovery"
 	"github.com/995933447/microgosuit/discovery/impl/etcd"
 	"github.com/995933447/microgosuit/discovery/impl/filecachedproxy"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
 	"github.com/995933447/microgosuit/env"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"sync"
-	"time"
 )
 
 var (
-	discover        discovery.Discovery
-	initDiscoveryMu sync.RWMutex
+	instances   = map[instanceKey]discovery.Discovery{}
+	instancesMu sync.RWMutex
 )
 
+// Deprecated: please use RegisterDriver.
 var CustomMakeDiscoveryFunc func(discoveryName string) (discovery.Discovery, error)
 
-func NewSpecDiscovery(discoverKeyPrefix, discoveryName string) (discovery.Discovery, error) {
-	switch discoveryName {
-	case env.DiscoveryEtcd:
-		return etcd.NewDiscovery(discoverKeyPrefix, time.Second*5, clientv3.Config{
-			Endpoints:   env.MustMeta().Etcd.Endpoints,
-			DialTimeout: time.Duration(env.MustMeta().Etcd.ConnectTimeoutMs) * time.Millisecond,
-		})
-	default:
-		if CustomMakeDiscoveryFunc != nil {
-			return CustomMakeDiscoveryFunc(discoveryName)
+// DriverCtor makes a Discovery of keyPrefix. cfg is the config section of the driver in env.Meta.Drivers, nil if
+// there is none.
+type DriverCtor func(keyPrefix string, cfg json.RawMessage) (discovery.Discovery, error)
+
+var (
+	drivers   = map[string]DriverCtor{}
+	driversMu sync.RWMutex
+)
+
+func init() {
+	RegisterDriver(env.DiscoveryEtcd, newEtcdDiscovery)
+	RegisterDriver(env.DiscoveryMemory, func(keyPrefix string, _ json.RawMessage) (discovery.Discovery, error) {
+		return memory.GetOrNewShared(keyPrefix), nil
+	})
+}
+
+// RegisterDriver makes a discovery driver available by name, for env.Meta.Discovery and env.Meta.DiscoveryProxy.Conn.
+// It panics if called twice with the same name or ctor is nil.
+func RegisterDriver(name string, ctor DriverCtor) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if ctor == nil {
+		panic("discovery: register driver ctor is nil")
+	}
+
+	if _, ok := drivers[name]; ok {
+		panic("discovery: register driver twice for " + name)
+	}
+
+	drivers[name] = ctor
+}
+
+// Drivers returns sorted names of the registered drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	var names []string
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// newEtcdDiscovery reads the config section of the driver, or env.Meta.Etcd if there is none.
+func newEtcdDiscovery(keyPrefix string, cfg json.RawMessage) (discovery.Discovery, error) {
+	etcdCfg := env.MustMeta().Etcd
+	if cfg != nil {
+		etcdCfg = env.Etcd{}
+		if err := json.Unmarshal(cfg, &etcdCfg); err != nil {
+			return nil, fmt.Errorf("json unmarshal config of discovery driver(%s) failed, err:%s", env.DiscoveryEtcd, err)
 		}
 	}
+
+	layout := etcd.LayoutNodeKey
+	if etcdCfg.Layout == env.EtcdLayoutService {
+		layout = etcd.LayoutSrvKey
+	}
+
+	return etcd.NewDiscovery(keyPrefix, time.Second*5, clientv3.Config{
+		Endpoints:   etcdCfg.Endpoints,
+		DialTimeout: time.Duration(etcdCfg.ConnectTimeoutMs) * time.Millisecond,
+	}, etcd.WithLayout(layout))
+}
+
+func NewSpecDiscovery(discoverKeyPrefix, discoveryName string) (discovery.Discovery, error) {
+	driversMu.RLock()
+	ctor, ok := drivers[discoveryName]
+	driversMu.RUnlock()
+	if ok {
+		return ctor(discoverKeyPrefix, env.MustMeta().Drivers[discoveryName])
+	}
+
+	if CustomMakeDiscoveryFunc != nil {
+		return CustomMakeDiscoveryFunc(discoveryName)
+	}
+
 	return nil, fmt.Errorf("no support discovery type(%s)", discoveryName)
 }
 
+// MigrateSrvKeys moves nodes of discoverKeyPrefix persisted in service keys into node keys by the etcd driver
+// discoveryName, it's for the transition from env.EtcdLayoutService to env.EtcdLayoutNode.
+func MigrateSrvKeys(ctx context.Context, discoverKeyPrefix, discoveryName string) error {
+	discover, err := NewSpecDiscovery(discoverKeyPrefix, discoveryName)
+	if err != nil {
+		return err
+	}
+	defer discover.Close(ctx)
+
+	migrator, ok := discover.(interface {
+		MigrateSrvKeys(ctx context.Context) error
+	})
+	if !ok {
+		return fmt.Errorf("discovery type(%s) has no service keys to migrate", discoveryName)
+	}
+
+	return migrator.MigrateSrvKeys(ctx)
+}
+
+type instanceKey struct {
+	keyPrefix     string
+	discoveryName string
+}
+
+// GetOrMakeDiscovery returns the instance of discoverKeyPrefix made by the discovery set in env.Meta.
 func GetOrMakeDiscovery(discoverKeyPrefix string) (discovery.Discovery, error) {
-	initDiscoveryMu.RLock()
-	if discover != nil {
-		initDiscoveryMu.RUnlock()
+	return GetOrMakeSpecDiscovery(discoverKeyPrefix, env.MustMeta().Discovery)
+}
+
+// GetOrMakeSpecDiscovery returns the instance of discoverKeyPrefix made by discoveryName, instances are made once
+// and shared until closed by CloseDiscovery.
+func GetOrMakeSpecDiscovery(discoverKeyPrefix, discoveryName string) (discovery.Discovery, error) {
+	key := instanceKey{
+		keyPrefix:     discoverKeyPrefix,
+		discoveryName: discoveryName,
+	}
+
+	instancesMu.RLock()
+	discover, ok := instances[key]
+	instancesMu.RUnlock()
+	if ok {
 		return discover, nil
 	}
-	initDiscoveryMu.RUnlock()
 
-	initDiscoveryMu.Lock()
-	defer initDiscoveryMu.Unlock()
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
 
-	if discover != nil {
+	if discover, ok = instances[key]; ok {
 		return discover, nil
 	}
 
 	var err error
-	if env.MustMeta().Discovery != env.DiscoveryFileCacheProxy {
-		discover, err = NewSpecDiscovery(discoverKeyPrefix, env.MustMeta().Discovery)
+	if discoveryName != env.DiscoveryFileCacheProxy {
+		discover, err = NewSpecDiscovery(discoverKeyPrefix, discoveryName)
 		if err != nil {
 			return nil, err
 		}
-		return discover, nil
+	} else {
+		conn, err := NewSpecDiscovery(discoverKeyPrefix, env.MustMeta().DiscoveryProxy.Conn)
+		if err != nil {
+			return nil, err
+		}
+		discover = filecachedproxy.NewDiscovery(env.MustMeta().DiscoveryProxy.Dir, conn)
 	}
 
-	conn, err := NewSpecDiscovery(discoverKeyPrefix, env.MustMeta().DiscoveryProxy.Conn)
-	if err != nil {
-		return nil, err
+	instances[key] = discover
+
+	return discover, nil
+}
+
+// CloseDiscovery closes the instance of discoverKeyPrefix made by discoveryName and forgets it, a new one is made
+// by the next GetOrMakeSpecDiscovery.
+func CloseDiscovery(ctx context.Context, discoverKeyPrefix, discoveryName string) error {
+	key := instanceKey{
+		keyPrefix:     discoverKeyPrefix,
+		discoveryName: discoveryName,
 	}
 
-	discover = filecachedproxy.NewDiscovery(env.MustMeta().DiscoveryProxy.Dir, conn)
+	instancesMu.Lock()
+	discover, ok := instances[key]
+	delete(instances, key)
+	instancesMu.Unlock()
 
-	return discover, nil
+	if !ok {
+		return nil
+	}
+
+	return discover.Close(ctx)
+}
+
+// CloseAllDiscoveries closes all instances made by factory.
+func CloseAllDiscoveries(ctx context.Context) error {
+	instancesMu.Lock()
+	discoveries := instances
+	instances = map[instanceKey]discovery.Discovery{}
+	instancesMu.Unlock()
+
+	var firstErr error
+	for _, discover := range discoveries {
+		if err := discover.Close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
 }
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+	"github.com/995933447/microgosuit/env"
+	"github.com/995933447/microgosuit/factory"
+)
+
+const customDriver = "test_custom"
+
+var initMetaOnce sync.Once
+
+// initMeta inits meta with the memory discovery and the config section of customDriver, it's done once since
+// meta is kept by the process.
+func initMeta(t *testing.T) {
+	t.Helper()
+	initMetaOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "microgosuit_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metaJson, err := json.Marshal(&env.Meta{
+			Env:       env.Test,
+			Discovery: env.DiscoveryMemory,
+			Drivers: map[string]json.RawMessage{
+				customDriver: json.RawMessage(`{"addr":"127.0.0.1:1"}`),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		metaFilePath := filepath.Join(dir, "meta.json")
+		if err = os.WriteFile(metaFilePath, metaJson, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = env.InitMeta(metaFilePath); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+type customCtorCall struct {
+	keyPrefix string
+	cfg       string
+}
+
+var (
+	registerCustomOnce sync.Once
+	customCtorCallsMu  sync.Mutex
+	customCtorCalls    []customCtorCall
+)
+
+// registerCustomDriver registers customDriver once, which makes memory discoveries and records how it's called.
+func registerCustomDriver() {
+	registerCustomOnce.Do(func() {
+		factory.RegisterDriver(customDriver, func(keyPrefix string, cfg json.RawMessage) (discovery.Discovery, error) {
+			customCtorCallsMu.Lock()
+			defer customCtorCallsMu.Unlock()
+			customCtorCalls = append(customCtorCalls, customCtorCall{keyPrefix: keyPrefix, cfg: string(cfg)})
+			return memory.NewDiscovery(), nil
+		})
+	})
+}
+
+func expectPanic(t *testing.T, contains string, fn func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		r := recover()
+		if r == nil {
+			t.Fatalf("expect panic with %q", contains)
+		}
+		if msg, _ := r.(string); !strings.Contains(msg, contains) {
+			t.Fatalf("expect panic with %q, got %v", contains, r)
+		}
+	}()
+	fn()
+}
+
+func TestRegisterDriver(t *testing.T) {
+	initMeta(t)
+	registerCustomDriver()
+
+	if drivers := factory.Drivers(); !reflect.DeepEqual(drivers, []string{env.DiscoveryEtcd, env.DiscoveryMemory, customDriver}) {
+		t.Fatalf("unexpected drivers %v", drivers)
+	}
+
+	customCtorCallsMu.Lock()
+	customCtorCalls = nil
+	customCtorCallsMu.Unlock()
+
+	if _, err := factory.NewSpecDiscovery(t.Name(), customDriver); err != nil {
+		t.Fatal(err)
+	}
+
+	customCtorCallsMu.Lock()
+	calls := customCtorCalls
+	customCtorCallsMu.Unlock()
+	// the driver gets its config section in meta
+	if expect := []customCtorCall{{keyPrefix: t.Name(), cfg: `{"addr":"127.0.0.1:1"}`}}; !reflect.DeepEqual(calls, expect) {
+		t.Fatalf("expect driver called by %+v, got %+v", expect, calls)
+	}
+
+	expectPanic(t, "twice", func() {
+		factory.RegisterDriver(customDriver, func(string, json.RawMessage) (discovery.Discovery, error) {
+			return memory.NewDiscovery(), nil
+		})
+	})
+	expectPanic(t, "twice", func() {
+		factory.RegisterDriver(env.DiscoveryMemory, func(string, json.RawMessage) (discovery.Discovery, error) {
+			return memory.NewDiscovery(), nil
+		})
+	})
+	expectPanic(t, "nil", func() {
+		factory.RegisterDriver("test_nil", nil)
+	})
+
+	if _, err := factory.NewSpecDiscovery(t.Name(), "test_unknown"); err == nil || !strings.Contains(err.Error(), "test_unknown") {
+		t.Fatalf("expect error of unknown driver, got %v", err)
+	}
+	if _, err := factory.GetOrMakeSpecDiscovery(t.Name(), "test_unknown"); err == nil {
+		t.Fatal("expect error of unknown driver")
+	}
+}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+	"github.com/995933447/microgosuit/env"
+	"github.com/995933447/microgosuit/factory"
+)
+
+func TestInstances(t *testing.T) {
+	initMeta(t)
+	registerCustomDriver()
+
+	ctx := context.Background()
+	// unique per run, since shared instances are kept by the process
+	runId := time.Now().UnixNano()
+	prefix1, prefix2 := fmt.Sprintf("%s/%d/1", t.Name(), runId), fmt.Sprintf("%s/%d/2", t.Name(), runId)
+
+	get := func(keyPrefix, driver string) discovery.Discovery {
+		t.Helper()
+		discover, err := factory.GetOrMakeSpecDiscovery(keyPrefix, driver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return discover
+	}
+
+	// kept per prefix and driver
+	memory1, custom1 := get(prefix1, env.DiscoveryMemory), get(prefix1, customDriver)
+	if get(prefix1, env.DiscoveryMemory) != memory1 || get(prefix1, customDriver) != custom1 {
+		t.Fatal("expect the same instance of the same prefix and driver")
+	}
+	if memory1 == custom1 {
+		t.Fatal("expect instances of different drivers differ")
+	}
+	if get(prefix2, env.DiscoveryMemory) == memory1 || get(prefix2, customDriver) == custom1 {
+		t.Fatal("expect instances of different prefixes differ")
+	}
+	if discover, err := factory.GetOrMakeDiscovery(prefix1); err != nil || discover != memory1 {
+		t.Fatalf("expect the instance of the driver in meta, got %v, err:%v", discover, err)
+	}
+
+	// closed and made again
+	if err := factory.CloseDiscovery(ctx, prefix1, customDriver); err != nil {
+		t.Fatal(err)
+	}
+	if get(prefix1, customDriver) == custom1 {
+		t.Fatal("expect a new instance made after closed")
+	}
+	if get(prefix1, env.DiscoveryMemory) != memory1 {
+		t.Fatal("expect instances of other drivers kept")
+	}
+
+	// the memory instance is shared with others in the process, which are never closed by the factory
+	registry := memory.GetOrNewShared(prefix1)
+	evtCh, err := registry.Watch(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = factory.CloseDiscovery(ctx, prefix1, env.DiscoveryMemory); err != nil {
+		t.Fatal(err)
+	}
+	if err = factory.MigrateSrvKeys(ctx, prefix1, env.DiscoveryMemory); err == nil {
+		t.Fatal("expect memory has no service keys to migrate")
+	}
+	if err = registry.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", 12014)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case evt, ok := <-evtCh:
+		if !ok {
+			t.Fatal("watch of the shared instance closed by the factory")
+		}
+		if evt.Srv.SrvName != "logv3" || len(evt.Srv.Nodes) != 1 {
+			t.Fatalf("unexpected event %+v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait watch event timeout")
+	}
+
+	if err = factory.CloseAllDiscoveries(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = registry.Discover(ctx, "logv3"); err != nil {
+		t.Fatalf("expect services of the shared instance kept, err:%v", err)
+	}
+
+	// a handle closed twice releases its reference once
+	other := memory.GetOrNewShared(prefix1)
+	for i := 0; i < 2; i++ {
+		if err = other.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case evt := <-evtCh:
+		t.Fatalf("expect watch kept by the other handle, got %+v", evt)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// closed by the last holder
+	if err = registry.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-evtCh:
+		if ok {
+			t.Fatal("expect watch closed by the last holder")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watch not closed by the last holder")
+	}
+}
@@ -12,6 +12,7 @@ require (
 	github.com/995933447/reflectutil v0.0.0-20220816152525-eaa34e263589
 	github.com/995933447/runtimeutil v0.0.0-20230427124214-00d5b30c3fd6
 	github.com/995933447/std-go v0.0.0-20220806175833-ab3496c0b696
+	github.com/995933447/stringhelper-go v0.0.0-20250929065315-35520d5c4337
 	github.com/coreos/etcd v3.3.27+incompatible
 	github.com/golang/protobuf v1.5.3
 	github.com/howeyc/fsnotify v0.9.0
@@ -25,7 +26,6 @@ require (
 
 require (
 	github.com/995933447/simpletrace v0.0.0-20230217061256-c25a914bd376 // indirect
-	github.com/995933447/stringhelper-go v0.0.0-20250929065315-35520d5c4337 // indirect
 	github.com/BurntSushi/toml v1.2.1 // indirect
 	github.com/coreos/go-semver v0.3.1 // indirect
 	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
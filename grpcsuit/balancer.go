@@ -0,0 +1,233 @@
+package grpcsuit
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/util"
+	"github.com/995933447/microgosuit/env"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+const (
+	// WeightedBalancerName is the grpc load balancing policy picking nodes in proportion to discovery.Node.Weight.
+	WeightedBalancerName = "microgosuit_weighted"
+	// ZoneAwareBalancerName is the weighted policy only picking nodes in the zone of caller, until their healthy
+	// capacity falls below the spill threshold.
+	ZoneAwareBalancerName = "microgosuit_zone_aware"
+)
+
+func init() {
+	balancer.Register(&weightedBalancerBuilder{name: WeightedBalancerName})
+	balancer.Register(&weightedBalancerBuilder{name: ZoneAwareBalancerName, zoneAware: true})
+}
+
+type zoneAwareConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+	Zone                              string  `json:"zone"`
+	SpillThreshold                    float64 `json:"spill_threshold"`
+}
+
+type addrNodeAttrKey struct{}
+
+// SetAddrNode attaches node to addr as a balancer attribute, which is not part of the identity of addr, so
+// changes of node never reconnect.
+func SetAddrNode(addr resolver.Address, node *discovery.Node) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(addrNodeAttrKey{}, node)
+	return addr
+}
+
+// GetAddrNode returns the node attached to addr by SetAddrNode.
+func GetAddrNode(addr resolver.Address) (*discovery.Node, bool) {
+	node, ok := addr.BalancerAttributes.Value(addrNodeAttrKey{}).(*discovery.Node)
+	return node, ok
+}
+
+// GetAddrLabels returns labels of the node attached to addr by SetAddrNode.
+func GetAddrLabels(addr resolver.Address) map[string]string {
+	node, ok := GetAddrNode(addr)
+	if !ok {
+		return nil
+	}
+	return node.Labels
+}
+
+type trafficSplitsAttrKey struct{}
+
+// trafficSplits wraps splits since values of attributes must be comparable.
+type trafficSplits struct {
+	splits []*discovery.TrafficSplit
+}
+
+// SetStateTrafficSplits attaches traffic splits of service to state, the balancers split calls by them.
+func SetStateTrafficSplits(state resolver.State, splits []*discovery.TrafficSplit) resolver.State {
+	state.Attributes = state.Attributes.WithValue(trafficSplitsAttrKey{}, &trafficSplits{splits: splits})
+	return state
+}
+
+// GetStateTrafficSplits returns traffic splits attached to state by SetStateTrafficSplits.
+func GetStateTrafficSplits(state resolver.State) []*discovery.TrafficSplit {
+	splits, ok := state.Attributes.Value(trafficSplitsAttrKey{}).(*trafficSplits)
+	if !ok {
+		return nil
+	}
+	return splits.splits
+}
+
+type weightedBalancerBuilder struct {
+	name      string
+	zoneAware bool
+}
+
+func (b *weightedBalancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	nodes := &addrNodes{}
+	return &weightedBalancer{
+		Balancer: base.NewBalancerBuilder(b.name, &weightedPickerBuilder{nodes: nodes}, base.Config{HealthCheck: true}).Build(cc, opts),
+		nodes:    nodes,
+	}
+}
+
+func (b *weightedBalancerBuilder) Name() string {
+	return b.name
+}
+
+func (b *weightedBalancerBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &zoneAwareConfig{}
+	if !b.zoneAware {
+		return cfg, nil
+	}
+
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Zone == "" {
+		cfg.Zone = env.GetZone()
+	}
+
+	return cfg, nil
+}
+
+// addrNodes keeps nodes of the latest resolved addresses. The base balancer hands the addresses which its
+// SubConns were created with to the picker builder, nodes attached to them are stale once nodes changed.
+type addrNodes struct {
+	mu     sync.RWMutex
+	nodes  map[string]*discovery.Node
+	splits []*discovery.TrafficSplit
+	cfg    *zoneAwareConfig
+}
+
+func (a *addrNodes) update(state balancer.ClientConnState) {
+	nodes := make(map[string]*discovery.Node, len(state.ResolverState.Addresses))
+	for _, addr := range state.ResolverState.Addresses {
+		if node, ok := GetAddrNode(addr); ok {
+			nodes[addr.Addr] = node
+		}
+	}
+
+	cfg, _ := state.BalancerConfig.(*zoneAwareConfig)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nodes = nodes
+	a.splits = GetStateTrafficSplits(state.ResolverState)
+	a.cfg = cfg
+}
+
+func (a *addrNodes) getSplits() []*discovery.TrafficSplit {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.splits
+}
+
+// filterByZone returns healthyNodes in zone of caller if the balancer is zone aware.
+func (a *addrNodes) filterByZone(healthyNodes []*discovery.Node) []*discovery.Node {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.cfg == nil || a.cfg.Zone == "" {
+		return healthyNodes
+	}
+
+	allNodes := make([]*discovery.Node, 0, len(a.nodes))
+	for _, node := range a.nodes {
+		allNodes = append(allNodes, node)
+	}
+
+	return util.FilterByZone(healthyNodes, allNodes, a.cfg.Zone, a.cfg.SpillThreshold)
+}
+
+func (a *addrNodes) get(addr resolver.Address) *discovery.Node {
+	a.mu.RLock()
+	node, ok := a.nodes[addr.Addr]
+	a.mu.RUnlock()
+	if ok {
+		return node
+	}
+
+	if node, ok = GetAddrNode(addr); ok {
+		return node
+	}
+
+	// addresses not resolved by microgosuit are balanced equally
+	return &discovery.Node{}
+}
+
+type weightedBalancer struct {
+	balancer.Balancer
+	nodes *addrNodes
+}
+
+func (b *weightedBalancer) UpdateClientConnState(state balancer.ClientConnState) error {
+	b.nodes.update(state)
+	return b.Balancer.UpdateClientConnState(state)
+}
+
+type weightedPickerBuilder struct {
+	nodes *addrNodes
+}
+
+func (b *weightedPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	picker := &weightedPicker{
+		subConnMap: map[*discovery.Node]balancer.SubConn{},
+	}
+	for subConn, subConnInfo := range info.ReadySCs {
+		node := b.nodes.get(subConnInfo.Address)
+		// every SubConn must be reachable by its node even if nodes are shared
+		if _, ok := picker.subConnMap[node]; ok {
+			copied := *node
+			node = &copied
+		}
+		picker.subConnMap[node] = subConn
+		picker.nodes = append(picker.nodes, node)
+	}
+
+	picker.nodes = b.nodes.filterByZone(picker.nodes)
+	picker.splits = b.nodes.getSplits()
+
+	return picker
+}
+
+type weightedPicker struct {
+	subConnMap map[*discovery.Node]balancer.SubConn
+	nodes      []*discovery.Node
+	splits     []*discovery.TrafficSplit
+}
+
+func (p *weightedPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	node, err := util.SelectNode(info.Ctx, p.nodes, p.splits)
+	if err != nil {
+		// calls fail with codes.Unavailable, or wait for a new picker if they are wait-for-ready
+		return balancer.PickResult{}, err
+	}
+
+	return balancer.PickResult{SubConn: p.subConnMap[node]}, nil
+}
@@ -16,49 +16,85 @@ func NewBuilder(ctx context.Context, resolveSchema, discoverKeyPrefix string) (r
 		return nil, err
 	}
 
+	return NewBuilderWithDiscovery(resolveSchema, discover)
+}
+
+// NewBuilderWithDiscovery makes a builder resolving services of resolveSchema by discover.
+func NewBuilderWithDiscovery(resolveSchema string, discover discovery.Discovery) (resolver.Builder, error) {
 	builder := &Builder{
 		srvNameToResolversMap: map[string]*elemutil.LinkedList{},
 		resolveSchema:         resolveSchema,
 	}
 
-	discover.OnSrvUpdated(func(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {
-		builder.mu.RLock()
-		defer builder.mu.RUnlock()
-
-		resolvers, ok := builder.srvNameToResolversMap[srv.SrvName]
-		if !ok {
-			return
-		}
-
-		_ = resolvers.Walk(func(node *elemutil.LinkedNode) (bool, error) {
-			node.Payload.(*Resolver).UpdateSrvCfg(srv)
-			return true, nil
-		})
-
-		customDoOnDiscoverSrvUpdated(ctx, evt, srv)
-	})
-
-	_, err = discover.LoadAll(ctx)
-	if err != nil {
+	if err := builder.rebind(discover); err != nil {
 		return nil, err
 	}
 
-	builder.discover = discover
-
 	return builder, nil
 }
 
 type Builder struct {
 	srvNameToResolversMap map[string]*elemutil.LinkedList
 	discover              discovery.Discovery
+	cancelWatch           context.CancelFunc
 	mu                    sync.RWMutex
 	resolveSchema         string
+	// keyPrefix and discoveryName are the factory instance the builder is bound to by InitSpecGrpcResolver
+	keyPrefix     string
+	discoveryName string
+}
+
+// rebind resolves services by discover from now on, resolvers built already are updated by its snapshots. The
+// watch lives until rebound again since the builder is registered to grpc globally.
+func (b *Builder) rebind(discover discovery.Discovery) error {
+	watchCtx, cancelWatch := context.WithCancel(context.Background())
+	evtCh, err := discover.Watch(watchCtx)
+	if err != nil {
+		cancelWatch()
+		return err
+	}
+
+	b.mu.Lock()
+	b.discover = discover
+	if b.cancelWatch != nil {
+		b.cancelWatch()
+	}
+	b.cancelWatch = cancelWatch
+	b.mu.Unlock()
+
+	go func() {
+		for evt := range evtCh {
+			b.onSrvUpdated(context.Background(), evt.Evt, evt.Srv)
+		}
+	}()
+
+	return nil
+}
+
+func (b *Builder) getDiscover() discovery.Discovery {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.discover
+}
+
+func (b *Builder) onSrvUpdated(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {
+	b.mu.RLock()
+	resolvers, ok := b.srvNameToResolversMap[srv.SrvName]
+	if ok {
+		_ = resolvers.Walk(func(node *elemutil.LinkedNode) (bool, error) {
+			node.Payload.(*Resolver).UpdateSrvCfg(srv)
+			return true, nil
+		})
+	}
+	b.mu.RUnlock()
+
+	customDoOnDiscoverSrvUpdated(ctx, evt, srv)
 }
 
 func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
 	srvName := target.Endpoint()
 
-	srv, err := b.discover.Discover(context.Background(), srvName)
+	srv, err := b.getDiscover().Discover(context.Background(), srvName)
 	if err != nil {
 		return nil, err
 	}
@@ -96,4 +132,34 @@ func (b *Builder) OnResolverClosed(resolve *Resolver) {
 	return
 }
 
+// ResolverState is the view of resolvers of a service built by a Builder.
+type ResolverState struct {
+	Scheme       string             `json:"scheme"`
+	SrvName      string             `json:"srv_name"`
+	ResolversNum int                `json:"resolvers_num"`
+	Srv          *discovery.Service `json:"service"`
+}
+
+// ResolverStates returns states of resolvers of every service resolved by the builder.
+func (b *Builder) ResolverStates() []*ResolverState {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var states []*ResolverState
+	for srvName, resolvers := range b.srvNameToResolversMap {
+		state := &ResolverState{
+			Scheme:       b.resolveSchema,
+			SrvName:      srvName,
+			ResolversNum: int(resolvers.Len()),
+		}
+		_ = resolvers.Walk(func(node *elemutil.LinkedNode) (bool, error) {
+			state.Srv = node.Payload.(*Resolver).GetSrv()
+			return false, nil
+		})
+		states = append(states, state)
+	}
+
+	return states
+}
+
 var _ resolver.Builder = (*Builder)(nil)
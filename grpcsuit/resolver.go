@@ -3,6 +3,7 @@ package grpcsuit
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/995933447/microgosuit/discovery"
 	"github.com/995933447/microgosuit/log"
@@ -20,11 +21,20 @@ func NewResolver(srvName string, cc resolver.ClientConn, builder *Builder) *Reso
 type Resolver struct {
 	srvName string
 	cc      resolver.ClientConn
+	srvMu   sync.RWMutex
+	srv     *discovery.Service
 	*Builder
 }
 
+// GetSrv returns the service resolved last time, nil if never resolved.
+func (r *Resolver) GetSrv() *discovery.Service {
+	r.srvMu.RLock()
+	defer r.srvMu.RUnlock()
+	return r.srv
+}
+
 func (r *Resolver) ResolveNow(options resolver.ResolveNowOptions) {
-	srv, err := r.Builder.discover.Discover(context.Background(), r.srvName)
+	srv, err := r.Builder.getDiscover().Discover(context.Background(), r.srvName)
 	if err != nil {
 		log.Logger.Error(nil, err)
 		return
@@ -42,15 +52,20 @@ func (r *Resolver) UpdateSrvCfg(srv *discovery.Service) {
 	}
 
 	state := resolver.State{}
+	state = SetStateTrafficSplits(state, srv.TrafficSplits)
 	for _, node := range srv.Nodes {
 		if !node.Available() {
 			continue
 		}
-		state.Addresses = append(state.Addresses, resolver.Address{
+		state.Addresses = append(state.Addresses, SetAddrNode(resolver.Address{
 			Addr: fmt.Sprintf("%s:%d", node.Host, node.Port),
-		})
+		}, node))
 	}
-	state.ServiceConfig = r.cc.ParseServiceConfig(`{"loadBalancingPolicy":"round_robin"}`)
+	state.ServiceConfig = r.cc.ParseServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, WeightedBalancerName))
+
+	r.srvMu.Lock()
+	r.srv = srv
+	r.srvMu.Unlock()
 
 	r.cc.UpdateState(state)
 }
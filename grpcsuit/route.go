@@ -0,0 +1,75 @@
+package grpcsuit
+
+import (
+	"context"
+
+	"github.com/995933447/microgosuit/discovery/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RouteCtxFunc decorates the context of every call before the balancer picks a node for it.
+type RouteCtxFunc func(ctx context.Context) context.Context
+
+// RouteDialOpts applies fn to contexts of all calls made by the client.
+func RouteDialOpts(fn RouteCtxFunc) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(fn(ctx), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(fn(ctx), desc, cc, method, opts...)
+		}),
+	}
+}
+
+// RoleDialOpts routes all calls made by the client by role, unless a call carries its own role by util.WithRole.
+func RoleDialOpts(role util.Role) []grpc.DialOption {
+	return RouteDialOpts(func(ctx context.Context) context.Context {
+		if _, ok := util.RoleFromCtx(ctx); ok {
+			return ctx
+		}
+		return util.WithRole(ctx, role)
+	})
+}
+
+// LaneMetadataKey is the key of grpc metadata carrying the lane of calls.
+const LaneMetadataKey = "x-microgosuit-lane"
+
+// LaneDialOpts routes all calls made by the client to nodes in lane, or baseline nodes if there is none in lane.
+// Lane is taken from util.WithLane, metadata of the outgoing call, or metadata of the incoming call the context
+// derived from, and is propagated to the metadata of the outgoing call so the following hops stay in lane.
+func LaneDialOpts() []grpc.DialOption {
+	return RouteDialOpts(propagateLane)
+}
+
+func propagateLane(ctx context.Context) context.Context {
+	outgoingLane := laneFromMetadata(metadata.FromOutgoingContext(ctx))
+
+	lane := util.LaneFromCtx(ctx)
+	if lane == "" {
+		lane = outgoingLane
+	}
+	if lane == "" {
+		lane = laneFromMetadata(metadata.FromIncomingContext(ctx))
+	}
+	if lane == "" {
+		return ctx
+	}
+
+	if outgoingLane == "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, LaneMetadataKey, lane)
+	}
+
+	return util.WithLane(ctx, lane)
+}
+
+func laneFromMetadata(md metadata.MD, ok bool) string {
+	if !ok {
+		return ""
+	}
+	if lanes := md.Get(LaneMetadataKey); len(lanes) > 0 {
+		return lanes[0]
+	}
+	return ""
+}
@@ -6,6 +6,8 @@ import (
 	"sync"
 
 	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/env"
+	"github.com/995933447/microgosuit/factory"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/balancer/roundrobin"
 	"google.golang.org/grpc/credentials/insecure"
@@ -21,6 +23,17 @@ var NotRoundRobinDialOpts = []grpc.DialOption{
 	grpc.WithTransportCredentials(insecure.NewCredentials()),
 }
 
+// ZoneAwareDialOpts balances calls by the ZoneAwareBalancerName policy. Calls only go to nodes in zone, or zone
+// of the process from env.GetZone if it's empty, and spill over to other zones once weight of healthy nodes in
+// zone falls below spillThreshold of all nodes in zone, it spills over only if none healthy if spillThreshold is 0.
+// Service configs from resolver are disabled, it can't be used with RoundRobinDialOpts.
+func ZoneAwareDialOpts(zone string, spillThreshold float64) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithDisableServiceConfig(),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig": [{"%s":{"zone":%q,"spill_threshold":%v}}]}`, ZoneAwareBalancerName, zone, spillThreshold)),
+	}
+}
+
 var (
 	customizedDialOpts                  []grpc.DialOption
 	customizedDialOptsMergedDefault     []grpc.DialOption
@@ -56,15 +69,70 @@ func GetCustomizedOptsMergedDefault() []grpc.DialOption {
 
 var customDoOnDiscoverSrvUpdated discovery.OnSrvUpdatedFunc = func(ctx context.Context, evt discovery.Evt, srv *discovery.Service) {}
 
+var (
+	builders   []*Builder
+	buildersMu sync.RWMutex
+)
+
+// InitGrpcResolver registers resolver of resolveSchema backed by discoverPrefix of the discovery set in env.Meta.
+// Schemes backed by different prefixes can be registered by calling it several times.
 func InitGrpcResolver(ctx context.Context, resolveSchema, discoverPrefix string) error {
-	builder, err := NewBuilder(ctx, resolveSchema, discoverPrefix)
+	return InitSpecGrpcResolver(ctx, resolveSchema, discoverPrefix, env.MustMeta().Discovery)
+}
+
+// InitSpecGrpcResolver registers resolver of resolveSchema backed by discoverPrefix of discoveryName. It does nothing
+// if resolveSchema is backed by the same discovery already, and fails if it's backed by another one. The scheme is
+// bound to the new instance if the one backing it is closed by factory.CloseDiscovery, resolvers built already
+// resolve by the new one.
+func InitSpecGrpcResolver(_ context.Context, resolveSchema, discoverPrefix, discoveryName string) error {
+	discover, err := factory.GetOrMakeSpecDiscovery(discoverPrefix, discoveryName)
+	if err != nil {
+		return err
+	}
+
+	buildersMu.Lock()
+	defer buildersMu.Unlock()
+
+	for _, builder := range builders {
+		if builder.resolveSchema != resolveSchema {
+			continue
+		}
+		if builder.getDiscover() == discover {
+			return nil
+		}
+		if builder.keyPrefix == discoverPrefix && builder.discoveryName == discoveryName {
+			return builder.rebind(discover)
+		}
+		return fmt.Errorf("grpc resolver of scheme(%s) is backed by another discovery already", resolveSchema)
+	}
+
+	b, err := NewBuilderWithDiscovery(resolveSchema, discover)
 	if err != nil {
 		return err
 	}
+	builder := b.(*Builder)
+	builder.keyPrefix = discoverPrefix
+	builder.discoveryName = discoveryName
 	resolver.Register(builder)
+
+	builders = append(builders, builder)
+
 	return nil
 }
 
+// GetResolverStates returns states of resolvers built by all builders registered by InitGrpcResolver.
+func GetResolverStates() []*ResolverState {
+	buildersMu.RLock()
+	defer buildersMu.RUnlock()
+
+	var states []*ResolverState
+	for _, builder := range builders {
+		states = append(states, builder.ResolverStates()...)
+	}
+
+	return states
+}
+
 func OnDiscoverSrvUpdated(fn discovery.OnSrvUpdatedFunc) {
 	customDoOnDiscoverSrvUpdated = fn
 }
@@ -2,12 +2,19 @@ package microgosuit
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/995933447/gonetutil"
+	"github.com/995933447/microgosuit/admin"
 	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/etcd"
 	"github.com/995933447/microgosuit/env"
 	"github.com/995933447/microgosuit/factory"
 	"github.com/995933447/microgosuit/grpcsuit"
@@ -44,31 +51,72 @@ type ServeGrpcReq struct {
 	SrvName                         string // Deprecated: please use field SrvNames
 	SrvNames                        []string
 	IpVar                           string
-	Port                            int
-	PProfIpVar                      string
-	PProfPort                       int
+	Port                            int    // a port picked by system is listened and registered if 0
+	PProfIpVar                      string // Deprecated: please use field AdminIpVar, pprof is served by the admin server
+	PProfPort                       int    // Deprecated: please use field AdminPort
+	AdminIpVar                      string
+	AdminPort                       int // admin server serving health, readiness, metrics, pprof and discovery view
 	RegisterCustomServiceServerFunc func(*grpc.Server) error
 	BeforeRegDiscover               func(discovery.Discovery, *discovery.Node) error
 	AfterRegDiscover                func(discovery.Discovery, *discovery.Node) error
 	OnReady                         func(*grpc.Server, *discovery.Node)
 	EnabledHealth                   bool
 	SrvOpts                         []grpc.ServerOption
+	DisabledLease                   bool          // register node without a lease, it stays until unregistered explicitly
+	LeaseTTL                        time.Duration // ttl of registration lease, discovery.DefaultLeaseTTL if zero
+	Labels                          map[string]string
+	Zone                            string // env.GetZone() if empty
+	Version                         string
+	Lane                            string                                                // lane the node is deployed in, it only serves calls tagged with lane
+	DrainPeriod                     time.Duration                                         // how long the node keeps serving after marked draining on shutdown
+	PropagationDelay                time.Duration                                         // how long the server keeps serving after unregistered on shutdown
+	GracefulStopTimeout             time.Duration                                         // DefaultGracefulStopTimeout if zero, the server is stopped forcibly after it
+	ShutdownSignals                 []os.Signal                                           // DefaultShutdownSignals if nil
+	DisabledSelfHealing             bool                                                  // not register node again once it disappeared from discovery
+	OnReRegistered                  func(srvName string, node *discovery.Node, err error) // called after every attempt of self healing
 }
 
+const DefaultGracefulStopTimeout = 10 * time.Second
+
+// adminShutdownTimeout bounds how long the admin server waits for requests in flight, e.g. pprof profiles.
+const adminShutdownTimeout = 5 * time.Second
+
+// DefaultShutdownSignals shut down ServeGrpc as ctx done.
+var DefaultShutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// ServeGrpc serves until ctx done or any of shutdown signals received. On shutdown, the node is marked draining
+// and unregistered, then the server is stopped gracefully, each step waits as configured by req. A second signal
+// skips the waits left.
 func ServeGrpc(ctx context.Context, req *ServeGrpcReq) error {
-	if req.PProfIpVar != "" && req.PProfPort > 0 {
+	adminIpVar, adminPort := req.AdminIpVar, req.AdminPort
+	if adminPort <= 0 {
+		adminIpVar, adminPort = req.PProfIpVar, req.PProfPort
+	}
+	var adminServer *admin.Server
+	if adminIpVar != "" && adminPort > 0 {
+		adminIp, err := gonetutil.EvalVarToParseIp(adminIpVar)
+		if err != nil {
+			log.Logger.Error(nil, err)
+		} else {
+			adminServer = admin.NewServer(fmt.Sprintf("%s:%d", adminIp, adminPort))
+		}
+	}
+	if adminServer != nil {
 		go func() {
-			ip, err := gonetutil.EvalVarToParseIp(req.PProfIpVar)
-			if err != nil {
+			if err := adminServer.ListenAndServe(); err != nil {
 				log.Logger.Error(nil, err)
-				return
 			}
-
-			err = http.ListenAndServe(fmt.Sprintf("%s:%d", ip, req.PProfPort), nil)
-			if err != nil {
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), adminShutdownTimeout)
+			defer cancel()
+			if err := adminServer.Shutdown(shutdownCtx); err != nil {
 				log.Logger.Error(nil, err)
 			}
 		}()
+	} else {
+		// keeps the view of the process even if not served
+		adminServer = admin.NewServer("")
 	}
 
 	ip, err := gonetutil.EvalVarToParseIp(req.IpVar)
@@ -76,7 +124,27 @@ func ServeGrpc(ctx context.Context, req *ServeGrpcReq) error {
 		return err
 	}
 
-	node := discovery.NewNode(ip, req.Port)
+	// listen before registering so the port picked by system is registered if req.Port is 0
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", ip, req.Port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	node := discovery.NewNode(ip, listener.Addr().(*net.TCPAddr).Port)
+	node.Labels = map[string]string{}
+	for key, val := range req.Labels {
+		node.Labels[key] = val
+	}
+	if req.Lane != "" {
+		node.Labels[discovery.LabelLane] = req.Lane
+	}
+	node.Zone = req.Zone
+	if node.Zone == "" {
+		node.Zone = env.GetZone()
+	}
+	node.Version = req.Version
+	node.StartedAt = time.Now().Unix()
 	grpcServer := grpc.NewServer(req.SrvOpts...)
 	if req.RegisterCustomServiceServerFunc != nil {
 		if err = req.RegisterCustomServiceServerFunc(grpcServer); err != nil {
@@ -97,11 +165,6 @@ func ServeGrpc(ctx context.Context, req *ServeGrpcReq) error {
 		health.RegisterHealthReporterServer(grpcServer, health.NewReporter(serviceNames))
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", ip, req.Port))
-	if err != nil {
-		return err
-	}
-
 	discover, err := factory.GetOrMakeDiscovery(req.RegDiscoverKeyPrefix)
 	if err != nil {
 		return err
@@ -113,21 +176,40 @@ func ServeGrpc(ctx context.Context, req *ServeGrpcReq) error {
 		}
 	}
 
+	register := func(ctx context.Context, serviceName string) error {
+		if req.DisabledLease {
+			return discover.Register(ctx, serviceName, node)
+		}
+		err := discover.RegisterWithLease(ctx, serviceName, node, req.LeaseTTL)
+		if errors.Is(err, etcd.ErrLeaseOnSrvKey) {
+			log.Logger.Warnf(ctx, "service %s is registered without lease by the service key layout", serviceName)
+			return discover.Register(ctx, serviceName, node)
+		}
+		return err
+	}
+
 	for _, serviceName := range serviceNames {
-		err = discover.Register(ctx, serviceName, node)
-		if err != nil {
+		if err = register(ctx, serviceName); err != nil {
 			return err
 		}
+		adminServer.AddRegistered(serviceName, node)
 	}
 
-	defer func() {
-		for _, serviceName := range serviceNames {
-			err = discover.Unregister(ctx, serviceName, node, true)
-			if err != nil {
-				log.Logger.Error(ctx, err)
+	var unregisterOnce sync.Once
+	unregister := func() {
+		unregisterOnce.Do(func() {
+			// ctx may be done already while shutting down
+			unregisterCtx := context.WithoutCancel(ctx)
+			for _, serviceName := range serviceNames {
+				err := discover.Unregister(unregisterCtx, serviceName, node, true)
+				if err != nil {
+					log.Logger.Error(unregisterCtx, err)
+				}
+				adminServer.RemoveRegistered(serviceName)
 			}
-		}
-	}()
+		})
+	}
+	defer unregister()
 
 	if req.AfterRegDiscover != nil {
 		if err = req.AfterRegDiscover(discover, node); err != nil {
@@ -139,10 +221,201 @@ func ServeGrpc(ctx context.Context, req *ServeGrpcReq) error {
 		req.OnReady(grpcServer, node)
 	}
 
-	err = grpcServer.Serve(listener)
-	if err != nil {
+	shutdownSignals := req.ShutdownSignals
+	if shutdownSignals == nil {
+		shutdownSignals = DefaultShutdownSignals
+	}
+	signCh := make(chan os.Signal, 1)
+	signal.Notify(signCh, shutdownSignals...)
+	defer signal.Stop(signCh)
+
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- grpcServer.Serve(listener)
+	}()
+
+	adminServer.SetReady(true)
+
+	stopSelfHealing := func() {}
+	if !req.DisabledSelfHealing {
+		healingCtx, cancelHealing := context.WithCancel(context.WithoutCancel(ctx))
+		healingDoneCh := make(chan struct{})
+		go func() {
+			defer close(healingDoneCh)
+			keepRegistered(healingCtx, discover, serviceNames, node, register, req.OnReRegistered)
+		}()
+		stopSelfHealing = func() {
+			cancelHealing()
+			<-healingDoneCh
+		}
+	}
+	defer stopSelfHealing()
+
+	// waits on shutdown are cut short by ctx done if shut down by a signal, or by a second signal
+	var hurryCh <-chan struct{}
+	select {
+	case err = <-serveErrCh:
 		return err
+	case <-ctx.Done():
+	case sign := <-signCh:
+		log.Logger.Infof(nil, "shutting down by signal %s", sign)
+		hurryCh = ctx.Done()
 	}
 
-	return nil
+	var hurried bool
+	waitOrHurry := func(d time.Duration) {
+		if hurried {
+			return
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return
+		case <-hurryCh:
+		case sign := <-signCh:
+			log.Logger.Warnf(nil, "shutting down without waiting by signal %s", sign)
+		}
+		hurried = true
+	}
+
+	adminServer.SetReady(false)
+	// the node is going to be drained and unregistered by the process itself
+	stopSelfHealing()
+
+	stopCtx := context.WithoutCancel(ctx)
+
+	if req.DrainPeriod > 0 {
+		for _, serviceName := range serviceNames {
+			if err = discover.Drain(stopCtx, serviceName, node); err != nil {
+				log.Logger.Error(stopCtx, err)
+			}
+		}
+		waitOrHurry(req.DrainPeriod)
+	}
+
+	unregister()
+
+	if req.PropagationDelay > 0 {
+		waitOrHurry(req.PropagationDelay)
+	}
+
+	gracefulStopTimeout := req.GracefulStopTimeout
+	if gracefulStopTimeout <= 0 {
+		gracefulStopTimeout = DefaultGracefulStopTimeout
+	}
+	stopGrpcServer(stopCtx, grpcServer, gracefulStopTimeout)
+
+	return <-serveErrCh
+}
+
+const maxReRegisterInterval = 30 * time.Second
+
+// keepRegistered watches serviceNames and registers node again with backoff whenever it disappears or is marked
+// dead, until ctx is done. The watch is subscribed again with backoff once it's closed.
+func keepRegistered(ctx context.Context, discover discovery.Discovery, serviceNames []string, node *discovery.Node, register func(ctx context.Context, serviceName string) error, onReRegistered func(srvName string, node *discovery.Node, err error)) {
+	reRegister := func(srvName string) bool {
+		log.Logger.Warnf(ctx, "node %s:%d disappeared from service %s, register again", node.Host, node.Port, srvName)
+
+		retryInterval := time.Second
+		for {
+			err := register(ctx, srvName)
+			if onReRegistered != nil {
+				onReRegistered(srvName, node, err)
+			}
+			if err == nil {
+				log.Logger.Infof(ctx, "registered node %s:%d to service %s again", node.Host, node.Port, srvName)
+				return true
+			}
+
+			log.Logger.Errorf(ctx, "register node %s:%d to service %s again failed, retry after %s, err:%s", node.Host, node.Port, srvName, retryInterval, err)
+
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(retryInterval):
+			}
+
+			retryInterval *= 2
+			if retryInterval > maxReRegisterInterval {
+				retryInterval = maxReRegisterInterval
+			}
+		}
+	}
+
+	retryInterval := time.Second
+	for {
+		evtCh, err := discover.Watch(ctx, serviceNames...)
+		if err != nil {
+			if errors.Is(err, discovery.ErrClosed) {
+				return
+			}
+			log.Logger.Errorf(ctx, "watch services %v to keep node registered failed, watch again after %s, err:%s", serviceNames, retryInterval, err)
+		} else {
+			// snapshots of the watch skip services not found, which may be removed before subscribed
+			for _, serviceName := range serviceNames {
+				if _, err = discover.Discover(ctx, serviceName); err != discovery.ErrSrvNotFound {
+					continue
+				}
+				if !reRegister(serviceName) {
+					return
+				}
+			}
+
+			for evt := range evtCh {
+				retryInterval = time.Second
+
+				if evt.Evt != discovery.EvtDeleted && hasLiveNode(evt.Srv, node) {
+					continue
+				}
+
+				if !reRegister(evt.Srv.SrvName) {
+					return
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Logger.Warnf(ctx, "watch of services %v to keep node registered closed, watch again after %s", serviceNames, retryInterval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+
+		retryInterval *= 2
+		if retryInterval > maxReRegisterInterval {
+			retryInterval = maxReRegisterInterval
+		}
+	}
+}
+
+func hasLiveNode(srv *discovery.Service, node *discovery.Node) bool {
+	for _, n := range srv.Nodes {
+		if n.Host == node.Host && n.Port == node.Port {
+			return n.Status&discovery.NodeStateDead == 0
+		}
+	}
+	return false
+}
+
+// stopGrpcServer stops server gracefully, and forcibly if in-flight calls are not finished after timeout.
+func stopGrpcServer(ctx context.Context, server *grpc.Server, timeout time.Duration) {
+	stoppedCh := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stoppedCh)
+	}()
+
+	select {
+	case <-stoppedCh:
+	case <-time.After(timeout):
+		log.Logger.Warnf(ctx, "grpc server not stopped gracefully after %s, stop forcibly", timeout)
+		server.Stop()
+		<-stoppedCh
+	}
 }
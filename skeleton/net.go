@@ -4,6 +4,8 @@ import (
 	"github.com/995933447/gonetutil"
 )
 
+// Deprecated: the port returned may be taken by others before listened, please listen on port 0 by
+// microgosuit.ServeGrpc instead, the port picked by system is registered.
 func RandomAvailableRpcPort() (int, error) {
 	port := 21000
 	for {
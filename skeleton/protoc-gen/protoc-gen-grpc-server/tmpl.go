@@ -88,30 +88,23 @@ var registerServiceServersFunc = func(server *grpc.Server) error {
 
 var portFileTemplate = `// Code generated by protoc-gen-grpc-server. DO NOT EDIT.
 package main
-
+{{ if ne .RpcPort "0" }}
 import (
-	"github.com/995933447/microgosuit/skeleton"
-	{{- if ne .RpcPort "0" }}
 	"{{.EnumImportPath}}"
-	{{- end }}
 )
 
 var rpcPort = {{.RpcPort}}
 
 func GetListenRpcPort() (int, error) {
-	if rpcPort > 0 {
-		return rpcPort, nil
-	}
-
-	port, err := skeleton.RandomAvailableRpcPort()
-	if err != nil {
-		return 0, err
-	}
-
-	rpcPort = port
-
 	return rpcPort, nil
 }
+{{- else }}
+// GetListenRpcPort returns 0 since no RpcPort enum defined, microgosuit.ServeGrpc listens on a port picked by
+// system and registers it.
+func GetListenRpcPort() (int, error) {
+	return 0, nil
+}
+{{- end }}
 `
 
 var serviceHandlerFileTemplate = `package handler
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+	"github.com/995933447/microgosuit/env"
+	"github.com/995933447/microgosuit/factory"
+	"github.com/995933447/microgosuit/grpcsuit"
+	"google.golang.org/grpc"
+)
+
+func TestGrpcResolverRebind(t *testing.T) {
+	initMeta(t)
+
+	ctx := context.Background()
+
+	// unique per run, since schemes registered to grpc and shared instances are kept by the process
+	runId := time.Now().UnixNano()
+	scheme := fmt.Sprintf("testrebind%d", runId)
+	keyPrefix := fmt.Sprintf("%s/%d/", t.Name(), runId)
+	// registered by a handle released at once, so the factory holds the last reference
+	register := func(port int) {
+		t.Helper()
+		registry := memory.GetOrNewShared(keyPrefix)
+		defer registry.Close(ctx)
+		if err := registry.Register(ctx, "logv3", discovery.NewNode("127.2.1.1", port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	register(12014)
+
+	if err := grpcsuit.InitSpecGrpcResolver(ctx, scheme, keyPrefix, env.DiscoveryMemory); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.NewClient(scheme+":///logv3", grpcsuit.RoundRobinDialOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Connect()
+
+	waitResolved := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			for _, state := range grpcsuit.GetResolverStates() {
+				if state.Scheme == scheme && state.Srv != nil && len(state.Srv.Nodes) == n {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("wait %d nodes resolved timeout", n)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitResolved(1)
+
+	// the watch of resolvers is closed with the instance, the scheme is bound to the one made again then
+	if err = factory.CloseDiscovery(ctx, keyPrefix, env.DiscoveryMemory); err != nil {
+		t.Fatal(err)
+	}
+	if err = grpcsuit.InitSpecGrpcResolver(ctx, scheme, keyPrefix, env.DiscoveryMemory); err != nil {
+		t.Fatal(err)
+	}
+	register(12015)
+	waitResolved(2)
+
+	if err = grpcsuit.InitSpecGrpcResolver(ctx, scheme, keyPrefix+"other/", env.DiscoveryMemory); err == nil {
+		t.Fatal("expect error of the scheme backed by another discovery")
+	}
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit"
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+)
+
+func TestSelfHealing(t *testing.T) {
+	keyPrefix := t.Name() + "/"
+	healCh := make(chan error, 10)
+	_, stop := serve(t, &microgosuit.ServeGrpcReq{
+		RegDiscoverKeyPrefix: keyPrefix,
+		SrvName:              "logv3",
+		IpVar:                "127.0.0.1",
+		OnReRegistered: func(_ string, _ *discovery.Node, err error) {
+			healCh <- err
+		},
+	})
+
+	ctx := context.Background()
+	registry := memory.GetOrNewShared(keyPrefix)
+	defer registry.Close(ctx)
+
+	waitHealed := func() {
+		t.Helper()
+		select {
+		case err := <-healCh:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("wait registered again timeout")
+		}
+
+		srv, err := registry.Discover(ctx, "logv3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srv.Nodes) != 1 || !srv.Nodes[0].Available() {
+			t.Fatalf("unexpected nodes %+v", srv.Nodes)
+		}
+	}
+
+	// healed as many times as removed
+	for i := 0; i < 2; i++ {
+		if err := registry.UnregisterAll(ctx, "logv3"); err != nil {
+			t.Fatal(err)
+		}
+		waitHealed()
+	}
+
+	// healed after the watch closed and subscribed again
+	registry.Unwatch()
+	if err := registry.UnregisterAll(ctx, "logv3"); err != nil {
+		t.Fatal(err)
+	}
+	waitHealed()
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(healCh) != 0 {
+		t.Fatal("registered again while shutting down")
+	}
+	if _, err := registry.Discover(ctx, "logv3"); err != discovery.ErrSrvNotFound {
+		t.Fatalf("expect ErrSrvNotFound, got %v", err)
+	}
+}
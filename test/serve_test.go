@@ -0,0 +1,127 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit"
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+	"github.com/995933447/microgosuit/env"
+	"google.golang.org/grpc"
+)
+
+var initMetaOnce sync.Once
+
+// initMeta inits meta with the memory discovery, it's done once since meta is kept by the process.
+func initMeta(t *testing.T) {
+	t.Helper()
+	initMetaOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "microgosuit_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metaJson, err := json.Marshal(&env.Meta{
+			Env:       env.Test,
+			Discovery: env.DiscoveryMemory,
+			Zone:      "z1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		metaFilePath := filepath.Join(dir, "meta.json")
+		if err = os.WriteFile(metaFilePath, metaJson, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = env.InitMeta(metaFilePath); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// serve runs ServeGrpc by req until stop is called, it returns once the node is registered.
+func serve(t *testing.T, req *microgosuit.ServeGrpcReq) (node *discovery.Node, stop func() error) {
+	t.Helper()
+	initMeta(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	readyCh := make(chan *discovery.Node, 1)
+	onReady := req.OnReady
+	req.OnReady = func(server *grpc.Server, node *discovery.Node) {
+		if onReady != nil {
+			onReady(server, node)
+		}
+		readyCh <- node
+	}
+
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- microgosuit.ServeGrpc(ctx, req)
+	}()
+
+	select {
+	case node = <-readyCh:
+	case err := <-doneCh:
+		t.Fatalf("serve failed, err:%v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait serving timeout")
+	}
+
+	return node, func() error {
+		cancel()
+		select {
+		case err := <-doneCh:
+			return err
+		case <-time.After(10 * time.Second):
+			t.Fatal("wait stopped timeout")
+		}
+		return nil
+	}
+}
+
+func TestServeOnPickedPort(t *testing.T) {
+	keyPrefix := t.Name() + "/"
+	node, stop := serve(t, &microgosuit.ServeGrpcReq{
+		RegDiscoverKeyPrefix: keyPrefix,
+		SrvNames:             []string{"logv3", "logv4"},
+		IpVar:                "127.0.0.1",
+		Port:                 0,
+	})
+
+	if node.Port == 0 {
+		t.Fatal("expect the port picked by system registered")
+	}
+
+	// the registered port is the one listened
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", node.Host, node.Port), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	registry := memory.GetOrNewShared(keyPrefix)
+	defer registry.Close(context.Background())
+	for _, srvName := range []string{"logv3", "logv4"} {
+		srv, err := registry.Discover(context.Background(), srvName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srv.Nodes) != 1 || srv.Nodes[0].Port != node.Port {
+			t.Fatalf("expect port %d registered to %s, got nodes %+v", node.Port, srvName, srv.Nodes)
+		}
+	}
+
+	if err = stop(); err != nil {
+		t.Fatal(err)
+	}
+}
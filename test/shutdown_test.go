@@ -0,0 +1,127 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/995933447/microgosuit"
+	"github.com/995933447/microgosuit/discovery"
+	"github.com/995933447/microgosuit/discovery/impl/memory"
+	"github.com/995933447/microgosuit/grpcsuit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	const (
+		drainPeriod         = 300 * time.Millisecond
+		propagationDelay    = 300 * time.Millisecond
+		gracefulStopTimeout = 300 * time.Millisecond
+		// slack of timers and delivery of events
+		slack = 50 * time.Millisecond
+	)
+
+	keyPrefix := t.Name() + "/"
+	node, stop := serve(t, &microgosuit.ServeGrpcReq{
+		RegDiscoverKeyPrefix: keyPrefix,
+		SrvName:              "logv3",
+		IpVar:                "127.0.0.1",
+		DrainPeriod:          drainPeriod,
+		PropagationDelay:     propagationDelay,
+		GracefulStopTimeout:  gracefulStopTimeout,
+		OnReady: func(server *grpc.Server, _ *discovery.Node) {
+			healthpb.RegisterHealthServer(server, health.NewServer())
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registry := memory.GetOrNewShared(keyPrefix)
+	defer registry.Close(context.Background())
+	evtCh, err := registry.Watch(ctx, "logv3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt := recvEvt(t, evtCh); len(evt.Srv.Nodes) != 1 || !evt.Srv.Nodes[0].Available() {
+		t.Fatalf("unexpected snapshot %+v", evt)
+	}
+
+	conn, err := grpc.NewClient(fmt.Sprintf("%s:%d", node.Host, node.Port), grpcsuit.NotRoundRobinDialOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	// the call in flight until the server is stopped forcibly
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	streamEndCh := make(chan time.Time, 1)
+	go func() {
+		for {
+			if _, err := stream.Recv(); err != nil {
+				streamEndCh <- time.Now()
+				return
+			}
+		}
+	}()
+
+	stoppingAt := time.Now()
+	stopErrCh := make(chan error, 1)
+	go func() {
+		stopErrCh <- stop()
+	}()
+
+	if evt := recvEvt(t, evtCh); len(evt.Srv.Nodes) != 1 || !evt.Srv.Nodes[0].IsDraining() {
+		t.Fatalf("expect node drained first, got %+v", evt)
+	}
+
+	if evt := recvEvt(t, evtCh); evt.Evt != discovery.EvtDeleted && len(evt.Srv.Nodes) != 0 {
+		t.Fatalf("expect node unregistered after drained, got %+v", evt)
+	}
+	unregisteredAt := time.Now()
+	if elapsed := unregisteredAt.Sub(stoppingAt); elapsed < drainPeriod {
+		t.Fatalf("unregistered after drained for %s, expect %s", elapsed, drainPeriod)
+	}
+
+	// the server keeps serving while unregistering propagates
+	if _, err = client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("expect serving after unregistered, err:%v", err)
+	}
+
+	select {
+	case streamEndAt := <-streamEndCh:
+		if elapsed := streamEndAt.Sub(unregisteredAt); elapsed < propagationDelay+gracefulStopTimeout-slack {
+			t.Fatalf("stopped forcibly %s after unregistered, expect %s", elapsed, propagationDelay+gracefulStopTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call in flight not ended after stopped")
+	}
+
+	if err = <-stopErrCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recvEvt(t *testing.T, evtCh <-chan *discovery.WatchEvt) *discovery.WatchEvt {
+	t.Helper()
+	select {
+	case evt, ok := <-evtCh:
+		if !ok {
+			t.Fatal("watch channel closed")
+		}
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait watch event timeout")
+	}
+	return nil
+}